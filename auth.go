@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Modes of the auth header check
+const (
+	// authModeEnforce rejects requests failing the check
+	authModeEnforce = "enforce"
+	// authModeAudit logs and counts requests failing the check and lets
+	// them through
+	authModeAudit = "audit"
+)
+
+// Reasons a request is denied for by the authorization rules, each one
+// is a label value of the denied request counter.
+const (
+	denyMissingCapability = "missing_capability"
+	denyMissingClaim      = "missing_claim"
+	denyClaimMismatch     = "claim_mismatch"
+	// denyNoToken is the reason of requests a rule matches whose auth
+	// policy is none or presence, they never carry validated claims.
+	denyNoToken = "no_token"
+)
+
+const (
+	// tokenClaimsKey is the echo context key of the claims of a valid
+	// bearer token.
+	tokenClaimsKey = "tokenClaims"
+	// denialKey is the echo context key of the reason a request was
+	// denied for.
+	denialKey = "authorizationDenial"
+	// auditedKey is the echo context key set once a request was audited,
+	// so that it is counted only once.
+	auditedKey = "authAudited"
+	// defaultCapabilitiesClaim is the claim holding the capabilities of
+	// XMiDT tokens.
+	defaultCapabilitiesClaim = "capabilities"
+)
+
+// The firmware label of the audit counter comes from a header clients
+// send, its values are bounded.
+const (
+	maxFirmwareLabels      = 100
+	maxFirmwareLabelLength = 64
+	otherFirmware          = "other"
+)
+
+// firmwareLabels are the firmware versions with their own label.
+var firmwareLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// authenticate checks the Authorization header if the auth header check
+// is enabled, as the auth policy of the request requires: a bearer token
+// valid for the JWKS keys or the presence of the header. The claims of
+// the token are kept for authorize. In audit mode failed checks are only
+// logged and counted.
+func authenticate() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := currentConfig()
+			if !cfg.authHeaderCheckEnabled {
+				return next(c)
+			}
+			authorization := c.Request().Header.Get("Authorization")
+			switch cfg.authPolicies.lookup(c.Request()) {
+			case authJWT:
+				claims, err := cfg.jwt.validate(authorization)
+				if err != nil {
+					if cfg.authHeaderCheckAudit {
+						auditAuth(c, cfg, err.Reason, err)
+						return next(c)
+					}
+					return rejectToken(c, err)
+				}
+				c.Set(tokenClaimsKey, claims)
+			case authPresence:
+				if len(authorization) > 0 {
+					break
+				}
+				if cfg.authHeaderCheckAudit {
+					auditAuth(c, cfg, tokenMissing, fmt.Errorf("authorization header not provided"))
+					return next(c)
+				}
+				log.Ctx(c.Request().Context()).Error().Msg("authorization header not provided")
+				return c.JSON(http.StatusBadRequest, echo.NewHTTPError(http.StatusBadRequest, "authorization header not provided"))
+			}
+			return next(c)
+		}
+	}
+}
+
+// authorize denies requests whose token does not satisfy the
+// authorization rules matching them with 403. In audit mode denials are
+// only logged and counted, requests whose token was rejected were already
+// counted by authenticate.
+func authorize() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := currentConfig()
+			claims, _ := c.Get(tokenClaimsKey).(*tokenClaims)
+			if reason, err := cfg.authorizer.authorize(c.Request(), claims); err != nil {
+				if cfg.authHeaderCheckAudit {
+					if c.Get(auditedKey) == nil {
+						auditAuth(c, cfg, reason, err)
+					}
+					return next(c)
+				}
+				log.Ctx(c.Request().Context()).Error().Msgf("denying request: %v", err)
+				c.Set(denialKey, reason)
+				return c.JSON(http.StatusForbidden, echo.NewHTTPError(http.StatusForbidden, reason))
+			}
+			return next(c)
+		}
+	}
+}
+
+// auditAuth logs and counts a request the auth check lets through in
+// audit mode, by tenant and firmware version.
+func auditAuth(c echo.Context, cfg *runtimeConfig, reason string, err error) {
+	c.Set(auditedKey, true)
+	req := c.Request()
+	tenant := cfg.tenants.label(req.Header.Get(tenantHeader))
+	firmware := firmwareVersion(req)
+	log.Ctx(req.Context()).Warn().Str("tenant", tenant).Str("firmware", firmware).Str("reason", reason).
+		Msgf("auth check audit, request would have been rejected: %v", err)
+	if registry != nil {
+		registry.AuthAuditFailures.WithLabelValues(tenant, firmwareLabel(firmware), reason).Inc()
+	}
+}
+
+// firmwareLabel returns the label of a firmware version. Only the first
+// maxFirmwareLabels versions get their own label, later ones as well as
+// too long or invalid versions are counted as other.
+func firmwareLabel(firmware string) string {
+	if len(firmware) > maxFirmwareLabelLength || !utf8.ValidString(firmware) {
+		return otherFirmware
+	}
+	firmwareLabels.Lock()
+	defer firmwareLabels.Unlock()
+	if firmwareLabels.seen[firmware] {
+		return firmware
+	}
+	if len(firmwareLabels.seen) >= maxFirmwareLabels {
+		return otherFirmware
+	}
+	firmwareLabels.seen[firmware] = true
+	return firmware
+}
+
+// claimRule requires the claim Name to be Value or, if Header is set,
+// the value of that request header. Header values are compared as
+// device ids, mac addresses ignore case and separators.
+type claimRule struct {
+	Name   string `mapstructure:"name"`
+	Value  string `mapstructure:"value"`
+	Header string `mapstructure:"header"`
+}
+
+// authorizationRule applies to requests whose path matches Path, a glob,
+// or PathRegex, an anchored regular expression, just like an auth policy,
+// and whose method is one of Methods, every method if empty. The token
+// must grant Capability, if set, and satisfy every claim rule.
+type authorizationRule struct {
+	Path       string      `mapstructure:"path"`
+	PathRegex  string      `mapstructure:"pathRegex"`
+	Methods    []string    `mapstructure:"methods"`
+	Capability string      `mapstructure:"capability"`
+	Claims     []claimRule `mapstructure:"claims"`
+
+	re *regexp.Regexp
+}
+
+func (r *authorizationRule) matches(req *http.Request) bool {
+	return r.re.MatchString(req.URL.Path) && matchesMethod(r.Methods, req.Method)
+}
+
+// authorizer applies the rules of the `authorization` section. Every
+// rule matching a request has to be satisfied, requests no rule matches
+// are allowed.
+type authorizer struct {
+	rules             []authorizationRule
+	capabilitiesClaim string
+}
+
+// newAuthorizer builds the rules of the `authorization` section, nil is
+// returned if there are none.
+func newAuthorizer(c AuthorizationConfig) (*authorizer, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	a := &authorizer{
+		// the rules are compiled in place, keep c untouched
+		rules:             append([]authorizationRule(nil), c.Rules...),
+		capabilitiesClaim: c.CapabilitiesClaim,
+	}
+	if a.capabilitiesClaim == "" {
+		a.capabilitiesClaim = defaultCapabilitiesClaim
+	}
+
+	for i := range a.rules {
+		rule := &a.rules[i]
+		re, err := pathRegexp(fmt.Sprintf("authorization.rules[%d]", i), rule.Path, rule.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		rule.re = re
+		if rule.Capability == "" && len(rule.Claims) == 0 {
+			return nil, fmt.Errorf("invalid authorization.rules[%d]: capability or claims are required", i)
+		}
+		for j, claim := range rule.Claims {
+			if claim.Name == "" {
+				return nil, fmt.Errorf("invalid authorization.rules[%d].claims[%d].name: must not be empty", i, j)
+			}
+			if (claim.Value == "") == (claim.Header == "") {
+				return nil, fmt.Errorf("invalid authorization.rules[%d].claims[%d]: one of value and header is required", i, j)
+			}
+		}
+	}
+	return a, nil
+}
+
+// authorize checks claims against the rules matching req, the reason of
+// a denial is returned with the error. Requests without claims are
+// denied by every rule matching them.
+func (a *authorizer) authorize(req *http.Request, claims *tokenClaims) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	var all map[string]interface{}
+	if claims != nil {
+		all = claims.all
+	}
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.matches(req) {
+			continue
+		}
+		if claims == nil {
+			return denyNoToken, fmt.Errorf("authorization.rules[%d] requires a bearer token, the auth policy does not validate one", i)
+		}
+		if rule.Capability != "" && !grants(all[a.capabilitiesClaim], rule.Capability) {
+			return denyMissingCapability, fmt.Errorf("token does not grant capability [%s]", rule.Capability)
+		}
+		for _, claim := range rule.Claims {
+			value, ok := all[claim.Name]
+			if !ok {
+				return denyMissingClaim, fmt.Errorf("token has no claim [%s]", claim.Name)
+			}
+			actual := fmt.Sprint(value)
+			if claim.Header != "" {
+				expected := req.Header.Get(claim.Header)
+				if expected == "" || normalizeDeviceID(actual) != normalizeDeviceID(expected) {
+					return denyClaimMismatch, fmt.Errorf("claim [%s] [%s] does not match header [%s] [%s]", claim.Name, actual, claim.Header, expected)
+				}
+			} else if actual != claim.Value {
+				return denyClaimMismatch, fmt.Errorf("claim [%s] [%s] is not [%s]", claim.Name, actual, claim.Value)
+			}
+		}
+	}
+	return "", nil
+}
+
+// grants tells whether one of the capabilities of a token grants
+// capability. Like in XMiDT the capabilities of tokens are regular
+// expressions, e.g. x1:webpa:.*:all grants x1:webpa:api:all.
+func grants(capabilities interface{}, capability string) bool {
+	list, _ := capabilities.([]interface{})
+	if s, ok := capabilities.(string); ok {
+		list = []interface{}{s}
+	}
+	for _, c := range list {
+		pattern, ok := c.(string)
+		if !ok {
+			continue
+		}
+		if pattern == capability {
+			return true
+		}
+		if re, err := regexp.Compile("^(?:" + pattern + ")$"); err == nil && re.MatchString(capability) {
+			return true
+		}
+	}
+	return false
+}
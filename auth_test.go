@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveAuth passes r through authenticate and authorize to a handler
+// answering 200.
+func serveAuth(r *http.Request) (*httptest.ResponseRecorder, echo.Context) {
+	w := httptest.NewRecorder()
+	c := echo.New().NewContext(r, w)
+	handler := authenticate()(authorize()(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}))
+	handler(c)
+	return w, c
+}
+
+// testAuthPolicies requires auth for every path.
+func testAuthPolicies(auth string) authPolicies {
+	return authPolicies{{Path: "/**", Auth: auth, re: regexp.MustCompile(globRegex("/**"))}}
+}
+
+// useTestAuth uses a copy of the current configuration with the test
+// JWKS and the given authorization rules, the copy shares the tenants
+// so the previous configuration is stored back without closing it.
+func useTestAuth(t *testing.T, rules []map[string]interface{}) {
+	t.Helper()
+	previous := currentConfig()
+	t.Cleanup(func() { current.Store(previous) })
+	j, _ := newTestJWTValidator(t)
+	cfg := *previous
+	cfg.jwt = j
+	cfg.authHeaderCheckEnabled = true
+	cfg.authPolicies = testAuthPolicies(authJWT)
+	cfg.authorizer = nil
+	if rules != nil {
+		v := testViper(t, map[string]interface{}{"authorization.rules": rules})
+		var err error
+		cfg.authorizer, err = newAuthorizer(loadTestConfig(t, v).Authorization)
+		require.NoError(t, err)
+	}
+	current.Store(&cfg)
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	useTestAuth(t, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set("Authorization", "Bearer garbage")
+	w, c := serveAuth(r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal(`Bearer realm="petasos-rewriter", error="invalid_token", error_description="malformed"`, w.Header().Get(authenticateHeader))
+	assert.Equal(tokenMalformed, c.Get(tokenFailureKey))
+
+	w, c = serveAuth(httptest.NewRequest(http.MethodGet, "/api/v2/device", nil))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal(`Bearer realm="petasos-rewriter"`, w.Header().Get(authenticateHeader))
+	assert.Nil(c.Get(tokenFailureKey), "missing headers are counted on their own")
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestToken(t, "ES256", "ec", testECKey, testClaims(nil)))
+	w, c = serveAuth(r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotNil(c.Get(tokenClaimsKey))
+
+	// the policy may only ask for the presence of the header
+	currentConfig().authPolicies = testAuthPolicies(authPresence)
+	r = httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set("Authorization", "Bearer garbage")
+	w, _ = serveAuth(r)
+	assert.Equal(http.StatusOK, w.Code)
+	w, _ = serveAuth(httptest.NewRequest(http.MethodGet, "/api/v2/device", nil))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	currentConfig().authPolicies = testAuthPolicies(authNone)
+	w, _ = serveAuth(httptest.NewRequest(http.MethodGet, "/api/v2/device", nil))
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestAuthorize(t *testing.T) {
+	useTestAuth(t, []map[string]interface{}{
+		{
+			"path":       "/api/v2/device",
+			"methods":    []string{"GET"},
+			"capability": "x1:webpa:device:connect",
+			"claims":     []map[string]interface{}{{"name": "sub", "header": "X-Webpa-Device-Name"}},
+		},
+		{
+			"path":   "/api/v2/device/config",
+			"claims": []map[string]interface{}{{"name": "role", "value": "admin"}},
+		},
+	})
+
+	testData := []struct {
+		method string
+		path   string
+		device string
+		claims map[string]interface{}
+		status int
+		reason string
+	}{
+		{http.MethodGet, "/api/v2/device", "mac:112233445566",
+			map[string]interface{}{"sub": "mac:11:22:33:44:55:66", "capabilities": []string{"x1:webpa:device:connect"}}, http.StatusOK, ""},
+		{http.MethodGet, "/api/v2/device", "mac:112233445566",
+			map[string]interface{}{"sub": "mac:112233445566", "capabilities": []string{"x1:other", "x1:webpa:.*"}}, http.StatusOK, ""},
+		{http.MethodPost, "/api/v2/device", "mac:112233445566",
+			map[string]interface{}{}, http.StatusOK, ""},
+		{http.MethodGet, "/api/v2/other", "",
+			map[string]interface{}{}, http.StatusOK, ""},
+		{http.MethodGet, "/api/v2/device", "mac:112233445566",
+			map[string]interface{}{"sub": "mac:112233445566"}, http.StatusForbidden, denyMissingCapability},
+		{http.MethodGet, "/api/v2/device", "mac:112233445566",
+			map[string]interface{}{"sub": "mac:112233445566", "capabilities": []string{"x1:webpa:api:.*"}}, http.StatusForbidden, denyMissingCapability},
+		{http.MethodGet, "/api/v2/device", "mac:112233445566",
+			map[string]interface{}{"capabilities": "x1:webpa:device:connect"}, http.StatusForbidden, denyMissingClaim},
+		{http.MethodGet, "/api/v2/device", "mac:665544332211",
+			map[string]interface{}{"sub": "mac:112233445566", "capabilities": []string{"x1:webpa:device:connect"}}, http.StatusForbidden, denyClaimMismatch},
+		{http.MethodGet, "/api/v2/device", "",
+			map[string]interface{}{"sub": "mac:112233445566", "capabilities": []string{"x1:webpa:device:connect"}}, http.StatusForbidden, denyClaimMismatch},
+		{http.MethodPut, "/api/v2/device/config", "",
+			map[string]interface{}{"role": "admin"}, http.StatusOK, ""},
+		{http.MethodPut, "/api/v2/device/config", "",
+			map[string]interface{}{"role": "user"}, http.StatusForbidden, denyClaimMismatch},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			r := httptest.NewRequest(record.method, record.path, nil)
+			r.Header.Set("X-Webpa-Device-Name", record.device)
+			r.Header.Set("Authorization", "Bearer "+signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(record.claims)))
+			w, c := serveAuth(r)
+			assert.Equal(record.status, w.Code)
+			if record.reason == "" {
+				assert.Nil(c.Get(denialKey))
+			} else {
+				assert.Equal(record.reason, c.Get(denialKey))
+			}
+		})
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	assert := assert.New(t)
+	useTestAuth(t, []map[string]interface{}{{"path": "/api/v2/device", "capability": "x1:webpa:device:connect"}})
+	currentConfig().authHeaderCheckAudit = true
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set("Authorization", "Bearer garbage")
+	w, c := serveAuth(r)
+	assert.Equal(http.StatusOK, w.Code, "invalid tokens are let through")
+	assert.Nil(c.Get(tokenFailureKey))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(nil)))
+	w, c = serveAuth(r)
+	assert.Equal(http.StatusOK, w.Code, "denied requests are let through")
+	assert.Nil(c.Get(denialKey))
+
+	currentConfig().authPolicies = testAuthPolicies(authPresence)
+	w, _ = serveAuth(httptest.NewRequest(http.MethodGet, "/api/v2/other", nil))
+	assert.Equal(http.StatusOK, w.Code, "requests without header are let through")
+}
+
+func TestAuthorizeWithoutToken(t *testing.T) {
+	useTestAuth(t, []map[string]interface{}{{"path": "/api/v2/device", "capability": "x1:webpa:device:connect"}})
+	token := "Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"capabilities": "x1:webpa:device:connect"}))
+
+	for _, auth := range []string{authPresence, authNone} {
+		t.Run(auth, func(t *testing.T) {
+			assert := assert.New(t)
+			currentConfig().authPolicies = testAuthPolicies(auth)
+			currentConfig().authHeaderCheckAudit = false
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+			r.Header.Set("Authorization", token)
+			w, c := serveAuth(r)
+			assert.Equal(http.StatusForbidden, w.Code, "tokens are not validated by the policy")
+			assert.Equal(denyNoToken, c.Get(denialKey))
+
+			r = httptest.NewRequest(http.MethodGet, "/api/v2/other", nil)
+			r.Header.Set("Authorization", token)
+			w, _ = serveAuth(r)
+			assert.Equal(http.StatusOK, w.Code)
+
+			currentConfig().authHeaderCheckAudit = true
+			r = httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+			r.Header.Set("Authorization", token)
+			w, c = serveAuth(r)
+			assert.Equal(http.StatusOK, w.Code)
+			assert.Equal(true, c.Get(auditedKey), "the denial is audited")
+		})
+	}
+}
+
+func TestFirmwareLabel(t *testing.T) {
+	assert := assert.New(t)
+	firmwareLabels.Lock()
+	firmwareLabels.seen = make(map[string]bool)
+	firmwareLabels.Unlock()
+
+	assert.Equal("005.033.001", firmwareLabel("005.033.001"))
+	assert.Equal(otherFirmware, firmwareLabel(strings.Repeat("x", maxFirmwareLabelLength+1)))
+	assert.Equal(otherFirmware, firmwareLabel("\xff"))
+	for i := 1; i < maxFirmwareLabels; i++ {
+		assert.Equal(strconv.Itoa(i), firmwareLabel(strconv.Itoa(i)))
+	}
+	assert.Equal(otherFirmware, firmwareLabel("006.000.000"), "versions beyond the limit share a label")
+	assert.Equal("005.033.001", firmwareLabel("005.033.001"))
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	testData := []struct {
+		rules interface{}
+		err   bool
+	}{
+		{[]map[string]interface{}{{"path": "/api/**", "capability": "x1:webpa"}}, false},
+		{[]map[string]interface{}{{"pathRegex": "/api/.*", "capability": "x1:webpa"}}, false},
+		{[]map[string]interface{}{{"capability": "x1:webpa"}}, true},
+		{[]map[string]interface{}{{"path": "/api/**", "pathRegex": "/api/.*", "capability": "x1:webpa"}}, true},
+		{[]map[string]interface{}{{"pathRegex": "(", "capability": "x1:webpa"}}, true},
+		{[]map[string]interface{}{{"path": "/api/**"}}, true},
+		{[]map[string]interface{}{{"path": "/api/**", "claims": []map[string]interface{}{{"name": "sub"}}}}, true},
+		{[]map[string]interface{}{{"path": "/api/**", "claims": []map[string]interface{}{{"name": "sub", "value": "a", "header": "b"}}}}, true},
+		{[]map[string]interface{}{{"path": "/api/**", "claims": []map[string]interface{}{{"value": "a"}}}}, true},
+		{"not a list", true},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v := testViper(t, map[string]interface{}{"authorization.rules": record.rules})
+			var a *authorizer
+			c, err := loadConfig(v)
+			if err == nil {
+				a, err = newAuthorizer(c.Authorization)
+			}
+			if record.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, a)
+			}
+		})
+	}
+
+	// paths are anchored like the ones of auth policies
+	v := testViper(t, map[string]interface{}{"authorization.rules": []map[string]interface{}{{"pathRegex": "api", "capability": "x1:webpa"}}})
+	a, err := newAuthorizer(loadTestConfig(t, v).Authorization)
+	require.NoError(t, err)
+	assert.False(t, a.rules[0].matches(httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)))
+
+	a, err = newAuthorizer(AuthorizationConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Strategies to pick a petasos backend
+const (
+	roundRobin       = "roundRobin"
+	leastOutstanding = "leastOutstanding"
+	consistentHash   = "consistentHash"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultEjectionDuration    = 30 * time.Second
+)
+
+// backend is one petasos instance.
+type backend struct {
+	url *url.URL
+
+	// outstanding requests, only changed atomically
+	outstanding int64
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+func (b *backend) String() string {
+	return b.url.String()
+}
+
+func (b *backend) isEjected(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.ejectedUntil)
+}
+
+// backendPool balances requests over the petasos instances of a tenant
+// and ejects instances which keep failing.
+type backendPool struct {
+	backends []*backend
+	byURL    map[string]*backend
+	strategy string
+	ring     *hashRing
+	next     uint64
+
+	maxFailures      int
+	ejectionDuration time.Duration
+}
+
+// newBackendPool builds the `petasos` section. petasos.endpoints wins
+// over the single petasos.endpoint.
+func newBackendPool(c PetasosConfig) (*backendPool, error) {
+	endpoints := c.Endpoints
+	if len(endpoints) == 0 && c.Endpoint != "" {
+		endpoints = []string{c.Endpoint}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("invalid petasos.endpoints: at least one endpoint is required")
+	}
+
+	p := &backendPool{
+		byURL:            make(map[string]*backend, len(endpoints)),
+		strategy:         c.Balancer.Strategy,
+		maxFailures:      c.Ejection.ConsecutiveFailures,
+		ejectionDuration: c.Ejection.Duration,
+	}
+	if p.strategy == "" {
+		p.strategy = roundRobin
+	}
+	if p.maxFailures <= 0 {
+		p.maxFailures = defaultConsecutiveFailures
+	}
+	if p.ejectionDuration <= 0 {
+		p.ejectionDuration = defaultEjectionDuration
+	}
+
+	for i, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid petasos.endpoints[%d]: %v", i, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid petasos.endpoints[%d] [%s]: scheme and host are required", i, endpoint)
+		}
+		if _, ok := p.byURL[u.String()]; ok {
+			continue
+		}
+		b := &backend{url: u}
+		p.backends = append(p.backends, b)
+		p.byURL[u.String()] = b
+	}
+
+	switch p.strategy {
+	case roundRobin, leastOutstanding:
+	case consistentHash:
+		nodes := make([]string, 0, len(p.backends))
+		for _, b := range p.backends {
+			nodes = append(nodes, b.String())
+		}
+		p.ring = newHashRing(nodes, defaultVnodeCount)
+	default:
+		return nil, fmt.Errorf("invalid petasos.balancer.strategy [%s], must be one of [%s, %s, %s]",
+			p.strategy, roundRobin, leastOutstanding, consistentHash)
+	}
+	return p, nil
+}
+
+// pick returns the backend for the next request of deviceName. Ejected
+// backends are skipped unless every backend is ejected.
+func (p *backendPool) pick(deviceName string) *backend {
+	now := time.Now()
+	healthy := func(b *backend) bool { return !b.isEjected(now) }
+	if b := p.pickWhere(deviceName, healthy); b != nil {
+		return b
+	}
+	return p.pickWhere(deviceName, func(*backend) bool { return true })
+}
+
+func (p *backendPool) pickWhere(deviceName string, accept func(*backend) bool) *backend {
+	switch p.strategy {
+	case leastOutstanding:
+		var best *backend
+		for _, b := range p.backends {
+			if accept(b) && (best == nil || atomic.LoadInt64(&b.outstanding) < atomic.LoadInt64(&best.outstanding)) {
+				best = b
+			}
+		}
+		return best
+	case consistentHash:
+		node, ok := p.ring.walk([]byte(deviceName), func(node string) bool { return accept(p.byURL[node]) })
+		if !ok {
+			return nil
+		}
+		return p.byURL[node]
+	default:
+		start := atomic.AddUint64(&p.next, 1) - 1
+		for i := 0; i < len(p.backends); i++ {
+			b := p.backends[(start+uint64(i))%uint64(len(p.backends))]
+			if accept(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+// acquire marks a request to b as outstanding, the returned function
+// has to be called once the request including its body is done.
+func (p *backendPool) acquire(b *backend) func() {
+	atomic.AddInt64(&b.outstanding, 1)
+	return func() {
+		atomic.AddInt64(&b.outstanding, -1)
+	}
+}
+
+// observe records the outcome of a round trip to b. Connection errors
+// and timeouts count as failures, any response resets the failure count.
+func (p *backendPool) observe(b *backend, latency time.Duration, failed bool) {
+	outcome := "success"
+	if failed {
+		outcome = "failure"
+	}
+	if registry != nil {
+		registry.BackendRequests.WithLabelValues(b.String(), outcome).Inc()
+		registry.BackendRequestDuration.WithLabelValues(b.String()).Observe(latency.Seconds())
+	}
+
+	b.mu.Lock()
+	if !failed {
+		b.consecutiveFailures = 0
+		b.mu.Unlock()
+		return
+	}
+	b.consecutiveFailures++
+	eject := b.consecutiveFailures >= p.maxFailures
+	if eject {
+		b.consecutiveFailures = 0
+		b.ejectedUntil = time.Now().Add(p.ejectionDuration)
+	}
+	b.mu.Unlock()
+
+	if eject {
+		log.Warn().Msgf("ejecting petasos backend [%s] for %s after %d consecutive failures", b, p.ejectionDuration, p.maxFailures)
+		if registry != nil {
+			registry.BackendEjections.WithLabelValues(b.String()).Inc()
+		}
+	}
+}
+
+// inherit takes over the backends of previous with the same url, so that
+// their outstanding requests and ejections survive a reload.
+func (p *backendPool) inherit(previous *backendPool) {
+	if p == nil || previous == nil {
+		return
+	}
+	for i, b := range p.backends {
+		if old, ok := previous.byURL[b.String()]; ok {
+			p.backends[i] = old
+			p.byURL[b.String()] = old
+		}
+	}
+}
+
+// urls returns the urls of all backends.
+func (p *backendPool) urls() []*url.URL {
+	urls := make([]*url.URL, 0, len(p.backends))
+	for _, b := range p.backends {
+		urls = append(urls, b.url)
+	}
+	return urls
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBackendPool(t *testing.T, strategy string) *backendPool {
+	t.Helper()
+	v := testViper(t, map[string]interface{}{
+		"petasos.endpoints":                    []string{"http://petasos-0:6400", "http://petasos-1:6400", "http://petasos-2:6400"},
+		"petasos.balancer.strategy":            strategy,
+		"petasos.ejection.consecutiveFailures": 2,
+		"petasos.ejection.duration":            "1m",
+	})
+	p, err := newBackendPool(loadTestConfig(t, v).Petasos)
+	require.NoError(t, err)
+	return p
+}
+
+func TestBackendPoolRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestBackendPool(t, roundRobin)
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, p.pick("").String())
+	}
+	assert.Equal([]string{
+		"http://petasos-0:6400", "http://petasos-1:6400", "http://petasos-2:6400",
+		"http://petasos-0:6400", "http://petasos-1:6400", "http://petasos-2:6400",
+	}, picked)
+}
+
+func TestBackendPoolLeastOutstanding(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestBackendPool(t, leastOutstanding)
+
+	release0 := p.acquire(p.backends[0])
+	release1 := p.acquire(p.backends[1])
+	assert.Equal(p.backends[2], p.pick(""))
+
+	release0()
+	assert.Equal(p.backends[0], p.pick(""))
+	release1()
+}
+
+func TestBackendPoolConsistentHash(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestBackendPool(t, consistentHash)
+
+	seen := make(map[*backend]bool)
+	for i := 0; i < 100; i++ {
+		device := "mac:1122334455" + strconv.Itoa(i)
+		b := p.pick(device)
+		assert.Equal(b, p.pick(device))
+		seen[b] = true
+	}
+	assert.Len(seen, 3)
+
+	// devices of an ejected backend move, all others stay
+	device := "mac:112233445566"
+	owner := p.pick(device)
+	p.observe(owner, time.Millisecond, true)
+	p.observe(owner, time.Millisecond, true)
+	assert.NotEqual(owner, p.pick(device))
+}
+
+func TestBackendPoolEjection(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestBackendPool(t, roundRobin)
+	b := p.backends[0]
+
+	p.observe(b, time.Millisecond, true)
+	p.observe(b, time.Millisecond, false)
+	p.observe(b, time.Millisecond, true)
+	assert.False(b.isEjected(time.Now()), "failures are consecutive only")
+
+	p.observe(b, time.Millisecond, true)
+	assert.True(b.isEjected(time.Now()))
+	assert.False(b.isEjected(time.Now().Add(2 * time.Minute)))
+	for i := 0; i < 6; i++ {
+		assert.NotEqual(b, p.pick(""))
+	}
+
+	// with every backend ejected requests are still sent somewhere
+	for _, other := range p.backends[1:] {
+		p.observe(other, time.Millisecond, true)
+		p.observe(other, time.Millisecond, true)
+	}
+	assert.NotNil(p.pick(""))
+}
+
+func TestNewBackendPool(t *testing.T) {
+	testData := []struct {
+		settings map[string]interface{}
+		urls     []string
+		err      bool
+	}{
+		{map[string]interface{}{"petasos.endpoint": "http://petasos:6400"}, []string{"http://petasos:6400"}, false},
+		{map[string]interface{}{"petasos.endpoint": "http://petasos:6400", "petasos.endpoints": []string{"http://a:1", "http://b:1", "http://a:1"}}, []string{"http://a:1", "http://b:1"}, false},
+		{map[string]interface{}{}, nil, true},
+		{map[string]interface{}{"petasos.endpoints": []string{"petasos:6400"}}, nil, true},
+		{map[string]interface{}{"petasos.endpoint": "http://petasos:6400", "petasos.balancer.strategy": "random"}, nil, true},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			p, err := newBackendPool(loadTestConfig(t, testViper(t, record.settings)).Petasos)
+			if record.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			var urls []string
+			for _, u := range p.urls() {
+				urls = append(urls, u.String())
+			}
+			assert.Equal(record.urls, urls)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Upstreams guarded by a circuit breaker
+const (
+	upstreamPetasos        = "petasos"
+	upstreamResourceUpdate = "resourceUpdate"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+const (
+	defaultFailureRateThreshold = 0.5
+	defaultMinRequests          = 20
+	defaultBreakerWindow        = 30 * time.Second
+	defaultCoolDown             = 10 * time.Second
+	defaultHalfOpenProbes       = 3
+)
+
+// ErrCircuitOpen is returned while a breaker rejects calls.
+var ErrCircuitOpen = fmt.Errorf("Circuit breaker is open")
+
+// circuitBreaker stops calls to an upstream whose failure rate, in a
+// tumbling window, exceeds the threshold. Calls slower than
+// slowCallThreshold count as failures. After coolDown a limited number
+// of probes is let through, their outcome closes or reopens the breaker.
+// A nil breaker is disabled and allows every call.
+type circuitBreaker struct {
+	upstream string
+	tenant   string
+
+	failureRateThreshold float64
+	slowCallThreshold    time.Duration
+	minRequests          int
+	window               time.Duration
+	coolDown             time.Duration
+	halfOpenProbes       int
+
+	mu             sync.Mutex
+	state          breakerState
+	windowStart    time.Time
+	requests       int
+	failures       int
+	openedAt       time.Time
+	probesInFlight int
+	probeSuccesses int
+}
+
+// newCircuitBreaker builds a `circuitBreaker.<upstream>` section, nil is
+// returned if the breaker is not enabled.
+func newCircuitBreaker(upstream, tenant string, c CircuitBreakerConfig) (*circuitBreaker, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	b := &circuitBreaker{
+		upstream:             upstream,
+		tenant:               tenant,
+		failureRateThreshold: c.FailureRateThreshold,
+		slowCallThreshold:    c.SlowCallThreshold,
+		minRequests:          c.MinRequests,
+		window:               c.Window,
+		coolDown:             c.CoolDown,
+		halfOpenProbes:       c.HalfOpenProbes,
+	}
+
+	key := "circuitBreaker." + upstream
+	switch {
+	case b.failureRateThreshold <= 0 || b.failureRateThreshold > 1:
+		return nil, fmt.Errorf("invalid %s.failureRateThreshold [%v], must be in (0, 1]", key, b.failureRateThreshold)
+	case b.minRequests <= 0:
+		return nil, fmt.Errorf("invalid %s.minRequests [%d], must be positive", key, b.minRequests)
+	case b.window <= 0:
+		return nil, fmt.Errorf("invalid %s.window [%s], must be positive", key, b.window)
+	case b.coolDown <= 0:
+		return nil, fmt.Errorf("invalid %s.coolDown [%s], must be positive", key, b.coolDown)
+	case b.halfOpenProbes <= 0:
+		return nil, fmt.Errorf("invalid %s.halfOpenProbes [%d], must be positive", key, b.halfOpenProbes)
+	}
+	return b, nil
+}
+
+// allow returns ErrCircuitOpen and the time after which a retry makes
+// sense if the call must not be made. Otherwise the returned function has
+// to be called with the outcome of the call.
+func (b *circuitBreaker) allow() (func(failed bool, latency time.Duration), time.Duration, error) {
+	if b == nil {
+		return func(bool, time.Duration) {}, 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerOpen {
+		if remaining := b.openedAt.Add(b.coolDown).Sub(now); remaining > 0 {
+			return nil, remaining, ErrCircuitOpen
+		}
+		b.transition(breakerHalfOpen, now)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.probesInFlight >= b.halfOpenProbes {
+			return nil, time.Second, ErrCircuitOpen
+		}
+		b.probesInFlight++
+		return b.probeDone, 0, nil
+	}
+
+	return b.done, 0, nil
+}
+
+// done records a call made while the breaker was closed.
+func (b *circuitBreaker) done(failed bool, latency time.Duration) {
+	failed = failed || (b.slowCallThreshold > 0 && latency > b.slowCallThreshold)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		// a call which started before the breaker opened
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart = now
+		b.requests, b.failures = 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.failureRateThreshold {
+		b.transition(breakerOpen, now)
+	}
+}
+
+// probeDone records a call made while the breaker was half-open.
+func (b *circuitBreaker) probeDone(failed bool, latency time.Duration) {
+	failed = failed || (b.slowCallThreshold > 0 && latency > b.slowCallThreshold)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerHalfOpen {
+		return
+	}
+
+	b.probesInFlight--
+	if failed {
+		b.transition(breakerOpen, time.Now())
+		return
+	}
+	b.probeSuccesses++
+	if b.probeSuccesses >= b.halfOpenProbes {
+		b.transition(breakerClosed, time.Now())
+	}
+}
+
+// transition has to be called with mu held.
+func (b *circuitBreaker) transition(to breakerState, now time.Time) {
+	log.Warn().Str("upstream", b.upstream).Str("tenant", b.tenant).
+		Msgf("circuit breaker changed from [%s] to [%s] (%d of %d calls failed)", b.state, to, b.failures, b.requests)
+
+	b.state = to
+	b.probesInFlight, b.probeSuccesses = 0, 0
+	switch to {
+	case breakerOpen:
+		b.openedAt = now
+	case breakerClosed:
+		b.windowStart = now
+		b.requests, b.failures = 0, 0
+	}
+	if registry != nil {
+		registry.CircuitBreakerState.WithLabelValues(b.upstream, b.tenant).Set(float64(to))
+	}
+}
+
+// inheritBreaker returns previous if b has its settings, so that the
+// state of a breaker survives a reload. Otherwise b replaces previous and
+// the state gauge is reset, or dropped if the breaker is gone.
+func inheritBreaker(b, previous *circuitBreaker) *circuitBreaker {
+	if b != nil && previous != nil && b.sameSettings(previous) {
+		return previous
+	}
+	if registry != nil {
+		if b != nil {
+			registry.CircuitBreakerState.WithLabelValues(b.upstream, b.tenant).Set(float64(breakerClosed))
+		} else if previous != nil {
+			registry.CircuitBreakerState.DeleteLabelValues(previous.upstream, previous.tenant)
+		}
+	}
+	return b
+}
+
+func (b *circuitBreaker) sameSettings(o *circuitBreaker) bool {
+	return b.upstream == o.upstream && b.tenant == o.tenant &&
+		b.failureRateThreshold == o.failureRateThreshold &&
+		b.slowCallThreshold == o.slowCallThreshold &&
+		b.minRequests == o.minRequests &&
+		b.window == o.window &&
+		b.coolDown == o.coolDown &&
+		b.halfOpenProbes == o.halfOpenProbes
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCircuitBreaker(t *testing.T) *circuitBreaker {
+	t.Helper()
+	b, err := newCircuitBreaker(upstreamPetasos, defaultTenant, CircuitBreakerConfig{
+		Enabled:              true,
+		FailureRateThreshold: 0.5,
+		SlowCallThreshold:    100 * time.Millisecond,
+		MinRequests:          4,
+		Window:               time.Minute,
+		CoolDown:             20 * time.Millisecond,
+		HalfOpenProbes:       2,
+	})
+	require.NoError(t, err)
+	return b
+}
+
+func breakerCall(b *circuitBreaker, failed bool, latency time.Duration) error {
+	done, _, err := b.allow()
+	if err != nil {
+		return err
+	}
+	done(failed, latency)
+	return nil
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	assert := assert.New(t)
+	b := newTestCircuitBreaker(t)
+
+	// below minRequests the breaker stays closed
+	assert.NoError(breakerCall(b, true, time.Millisecond))
+	assert.NoError(breakerCall(b, true, time.Millisecond))
+	assert.NoError(breakerCall(b, false, time.Millisecond))
+	assert.Equal(breakerClosed, b.state)
+
+	// a slow call is a failure, 3 of 4 failed
+	assert.NoError(breakerCall(b, false, time.Second))
+	assert.Equal(breakerOpen, b.state)
+
+	_, retryAfter, err := b.allow()
+	assert.Equal(ErrCircuitOpen, err)
+	assert.True(retryAfter > 0 && retryAfter <= 20*time.Millisecond)
+
+	// after the cool-down only halfOpenProbes calls are let through
+	time.Sleep(25 * time.Millisecond)
+	probe1, _, err := b.allow()
+	assert.NoError(err)
+	assert.Equal(breakerHalfOpen, b.state)
+	probe2, _, err := b.allow()
+	assert.NoError(err)
+	_, _, err = b.allow()
+	assert.Equal(ErrCircuitOpen, err)
+
+	// a failed probe opens the breaker again
+	probe1(true, time.Millisecond)
+	assert.Equal(breakerOpen, b.state)
+	probe2(false, time.Millisecond)
+	assert.Equal(breakerOpen, b.state)
+
+	// successful probes close it
+	time.Sleep(25 * time.Millisecond)
+	assert.NoError(breakerCall(b, false, time.Millisecond))
+	assert.Equal(breakerHalfOpen, b.state)
+	assert.NoError(breakerCall(b, false, time.Millisecond))
+	assert.Equal(breakerClosed, b.state)
+	assert.Equal(0, b.requests)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	assert := assert.New(t)
+	b, err := newCircuitBreaker(upstreamPetasos, defaultTenant, CircuitBreakerConfig{})
+	assert.NoError(err)
+	assert.Nil(b)
+	for i := 0; i < 100; i++ {
+		assert.NoError(breakerCall(b, true, time.Minute))
+	}
+}
+
+func TestNewCircuitBreakerInvalid(t *testing.T) {
+	testData := []map[string]interface{}{
+		{"circuitBreaker.petasos.failureRateThreshold": 0},
+		{"circuitBreaker.petasos.failureRateThreshold": 1.5},
+		{"circuitBreaker.petasos.minRequests": 0},
+		{"circuitBreaker.petasos.window": "0s"},
+		{"circuitBreaker.petasos.coolDown": "-1s"},
+		{"circuitBreaker.petasos.halfOpenProbes": 0},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v := testViper(t, record)
+			v.Set("circuitBreaker.petasos.enabled", true)
+			_, err := newCircuitBreaker(upstreamPetasos, defaultTenant, loadTestConfig(t, v).CircuitBreaker.Petasos)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestForwarderFailsFastWhileBreakerIsOpen(t *testing.T) {
+	assert := assert.New(t)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		calls++
+		response.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	routeToPetasos(t, server.URL)
+	currentConfig().tenants.defaultRouting.petasosBreaker = newTestCircuitBreaker(t)
+	currentConfig().tenants.defaultRouting.petasosBreaker.coolDown = time.Minute
+
+	for i := 0; i < 6; i++ {
+		r := httptest.NewRequest("", "/api/v2/device", nil)
+		w := httptest.NewRecorder()
+		assert.Nil(forwarder(echo.New().NewContext(r, w), &http.Client{}))
+		if i < 4 {
+			assert.Equal(http.StatusInternalServerError, w.Code)
+			continue
+		}
+		assert.Equal(http.StatusServiceUnavailable, w.Code)
+		assert.Equal("60", w.Header().Get("Retry-After"))
+		assert.Equal(problemContentType, w.Header().Get("Content-Type"))
+	}
+	assert.Equal(4, calls)
+}
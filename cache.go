@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultCacheTTL     = 5 * time.Minute
+	defaultCacheMaxSize = 100000
+)
+
+// deviceCache keeps the rewritten redirects per device, it is configured
+// at startup. A nil cache is disabled.
+var deviceCache *redirectCache
+
+// cachedRedirect is a rewritten redirect as sent to the device.
+type cachedRedirect struct {
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+type cacheEntry struct {
+	key    string
+	tenant string
+	value  *cachedRedirect
+}
+
+// redirectCache is a LRU cache of rewritten redirects. Entries older than
+// ttl are not served anymore, unless petasos cannot be asked: then they
+// are served as stale entries for up to maxStale after the ttl, forever
+// if maxStale is 0.
+type redirectCache struct {
+	ttl      time.Duration
+	maxStale time.Duration
+	maxSize  int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// newRedirectCache builds the `cache` section, nil is returned if the
+// cache is not enabled.
+func newRedirectCache(config CacheConfig) (*redirectCache, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	c := &redirectCache{
+		ttl:      config.TTL,
+		maxStale: config.MaxStale,
+		maxSize:  config.MaxSize,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+
+	switch {
+	case c.ttl <= 0:
+		return nil, fmt.Errorf("invalid cache.ttl [%s], must be positive", c.ttl)
+	case c.maxSize <= 0:
+		return nil, fmt.Errorf("invalid cache.maxSize [%d], must be positive", c.maxSize)
+	case c.maxStale < 0:
+		return nil, fmt.Errorf("invalid cache.maxStale [%s], must not be negative", c.maxStale)
+	}
+	return c, nil
+}
+
+// cacheKey returns the key of a request or "" if it is not cached, only
+// GET requests of a device are. The request URI is part of the key
+// because petasos keeps it in the Location, the scheme because the one of
+// the request becomes the one of the Location unless server.fixedScheme
+// is set.
+func cacheKey(cfg *runtimeConfig, route *routing, req *http.Request, originalRequestScheme string) string {
+	deviceName := req.Header.Get("X-Webpa-Device-Name")
+	if req.Method != http.MethodGet || deviceName == "" {
+		return ""
+	}
+	scheme := cfg.fixedScheme
+	if scheme == "" {
+		scheme = originalRequestScheme
+	}
+	return route.tenant + "\x00" + deviceName + "\x00" + scheme + "\x00" + req.URL.RequestURI()
+}
+
+// fresh returns the entry of key if it is younger than ttl.
+func (c *redirectCache) fresh(key, tenant string) (*cachedRedirect, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok || time.Since(el.Value.(*cacheEntry).value.storedAt) > c.ttl {
+		if registry != nil {
+			registry.RedirectCacheMisses.WithLabelValues(tenant).Inc()
+		}
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	if registry != nil {
+		registry.RedirectCacheHits.WithLabelValues(tenant).Inc()
+	}
+	return el.Value.(*cacheEntry).value, true
+}
+
+// stale returns the entry of key while it may still be served stale.
+func (c *redirectCache) stale(key, tenant string) (*cachedRedirect, bool) {
+	if c == nil || key == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	value := el.Value.(*cacheEntry).value
+	if c.maxStale > 0 && time.Since(value.storedAt) > c.ttl+c.maxStale {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	if registry != nil {
+		registry.RedirectCacheStaleServes.WithLabelValues(tenant).Inc()
+	}
+	return value, true
+}
+
+// put stores value under key and evicts the least recently used entries
+// beyond maxSize.
+func (c *redirectCache) put(key, tenant string, value *cachedRedirect) {
+	if c == nil || key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, tenant: tenant, value: value})
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		if registry != nil {
+			registry.RedirectCacheEvictions.WithLabelValues(entry.tenant).Inc()
+		}
+	}
+}
+
+// writeCachedRedirect answers the request with a cached redirect.
+func writeCachedRedirect(c echo.Context, cached *cachedRedirect) error {
+	for k, v := range cached.header {
+		c.Response().Header()[k] = append([]string(nil), v...)
+	}
+	c.Response().WriteHeader(cached.status)
+	if _, err := c.Response().Write(cached.body); err != nil {
+		return handleForwardError(c, newForwardError(errClientDisconnected, err))
+	}
+	return nil
+}
+
+// serveStale answers with a stale cached redirect if there is one, cause
+// is why petasos could not be asked.
+func serveStale(c echo.Context, route *routing, key string, cause error) (bool, error) {
+	cached, ok := deviceCache.stale(key, route.tenant)
+	if !ok {
+		return false, nil
+	}
+	log.Ctx(c.Request().Context()).Warn().Msgf("serving stale redirect for device name [%s]: %v",
+		c.Request().Header.Get("X-Webpa-Device-Name"), cause)
+	return true, writeCachedRedirect(c, cached)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedirectCache(t *testing.T, settings map[string]interface{}) *redirectCache {
+	t.Helper()
+	v := testViper(t, settings)
+	v.Set("cache.enabled", true)
+	c, err := newRedirectCache(loadTestConfig(t, v).Cache)
+	require.NoError(t, err)
+	return c
+}
+
+func TestRedirectCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestRedirectCache(t, map[string]interface{}{"cache.maxSize": 2})
+
+	c.put("a", defaultTenant, &cachedRedirect{status: 307, storedAt: time.Now()})
+	c.put("b", defaultTenant, &cachedRedirect{status: 307, storedAt: time.Now()})
+	_, ok := c.fresh("a", defaultTenant)
+	assert.True(ok)
+	c.put("c", defaultTenant, &cachedRedirect{status: 307, storedAt: time.Now()})
+
+	_, ok = c.fresh("b", defaultTenant)
+	assert.False(ok)
+	_, ok = c.fresh("a", defaultTenant)
+	assert.True(ok)
+	_, ok = c.fresh("c", defaultTenant)
+	assert.True(ok)
+}
+
+func TestRedirectCacheExpiry(t *testing.T) {
+	assert := assert.New(t)
+	c := newTestRedirectCache(t, map[string]interface{}{"cache.ttl": "1m", "cache.maxStale": "1h"})
+
+	c.put("expired", defaultTenant, &cachedRedirect{storedAt: time.Now().Add(-2 * time.Minute)})
+	_, ok := c.fresh("expired", defaultTenant)
+	assert.False(ok)
+	_, ok = c.stale("expired", defaultTenant)
+	assert.True(ok)
+
+	c.put("too-old", defaultTenant, &cachedRedirect{storedAt: time.Now().Add(-2 * time.Hour)})
+	_, ok = c.stale("too-old", defaultTenant)
+	assert.False(ok)
+	_, ok = c.entries["too-old"]
+	assert.False(ok, "entries past maxStale are dropped")
+}
+
+func TestRedirectCacheDisabled(t *testing.T) {
+	assert := assert.New(t)
+	c, err := newRedirectCache(CacheConfig{})
+	assert.NoError(err)
+	assert.Nil(c)
+	c.put("a", defaultTenant, &cachedRedirect{storedAt: time.Now()})
+	_, ok := c.fresh("a", defaultTenant)
+	assert.False(ok)
+	_, ok = c.stale("a", defaultTenant)
+	assert.False(ok)
+}
+
+func TestNewRedirectCacheInvalid(t *testing.T) {
+	testData := []map[string]interface{}{
+		{"cache.ttl": "0s"},
+		{"cache.maxSize": 0},
+		{"cache.maxStale": "-1s"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v := testViper(t, record)
+			v.Set("cache.enabled", true)
+			_, err := newRedirectCache(loadTestConfig(t, v).Cache)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestForwarderServesCachedRedirects(t *testing.T) {
+	assert := assert.New(t)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		calls++
+		response.Header().Set("Location", "http://xmidt-talaria:6200/api/v2/device")
+		response.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	routeToPetasos(t, server.URL)
+	deviceCache = newTestRedirectCache(t, map[string]interface{}{"cache.ttl": "1m"})
+	defer func() { deviceCache = nil }()
+
+	request := func(proto string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+		r.Header.Set("X-Webpa-Device-Name", "mac:112233445566")
+		r.Header.Set("X-Forwarded-Proto", proto)
+		w := httptest.NewRecorder()
+		assert.Nil(forwarder(echo.New().NewContext(r, w), &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}))
+		return w
+	}
+
+	first := request("wss")
+	second := request("wss")
+	assert.Equal(1, calls)
+	assert.Equal(http.StatusTemporaryRedirect, second.Code)
+	assert.Equal(first.Header().Get("Location"), second.Header().Get("Location"))
+
+	// redirects are cached per scheme, it becomes the one of the Location
+	plain := request("ws")
+	assert.Equal(2, calls)
+	assert.Equal("http://xmidt-talaria.dev.rdk.yo-digital.com/api/v2/device", plain.Header().Get("Location"))
+	assert.Equal("https://xmidt-talaria.dev.rdk.yo-digital.com/api/v2/device", request("wss").Header().Get("Location"))
+	assert.Equal(2, calls)
+
+	// expired entries are served while petasos is unreachable
+	for _, el := range deviceCache.entries {
+		el.Value.(*cacheEntry).value.storedAt = time.Now().Add(-time.Hour)
+	}
+	server.Close()
+	stale := request("wss")
+	assert.Equal(http.StatusTemporaryRedirect, stale.Code)
+	assert.Equal(first.Header().Get("Location"), stale.Header().Get("Location"))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// certModeOff disables a certificate rule, the other modes are the ones
+// of the auth header check. An unquoted off in YAML is the boolean false,
+// which is accepted as off too.
+const certModeOff = "off"
+
+// Certificate rules, each one is a label value of the violation counter
+const (
+	certRuleIssuer   = "issuer"
+	certRuleExpiry   = "expiry"
+	certRuleDeviceCN = "deviceCN"
+)
+
+// Reasons a certificate violates a rule
+const (
+	certIssuerNotAllowed = "issuer_not_allowed"
+	certExpired          = "expired"
+	certExpiring         = "expiring"
+	certInvalidExpiry    = "invalid_expiry"
+	certCNMismatch       = "cn_mismatch"
+)
+
+// certExpiryLayout is the format of X-Cert-Expiry-Date, the one of
+// openssl, e.g. Sep 19 23:59:59 2031 GMT.
+const certExpiryLayout = "Jan _2 15:04:05 2006 MST"
+
+// certViolation is a rule the device certificate violates.
+type certViolation struct {
+	rule   string
+	mode   string
+	reason string
+	err    error
+}
+
+// certificatePolicy checks the device certificate as described by the
+// headers of the TLS terminator. Every rule is off, enforced or audited.
+type certificatePolicy struct {
+	issuerMode     string
+	allowedIssuers []string
+	expiryMode     string
+	expiryDays     int
+	deviceCNMode   string
+}
+
+// newCertificatePolicy builds the rules of the `certificatePolicy`
+// section, nil is returned if every rule is off.
+func newCertificatePolicy(c CertificatePolicyConfig) (*certificatePolicy, error) {
+	p := &certificatePolicy{
+		issuerMode:     c.Issuer.Mode,
+		allowedIssuers: c.Issuer.Allowed,
+		expiryMode:     c.Expiry.Mode,
+		expiryDays:     c.Expiry.Days,
+		deviceCNMode:   c.DeviceCN.Mode,
+	}
+	for rule, mode := range map[string]*string{
+		certRuleIssuer:   &p.issuerMode,
+		certRuleExpiry:   &p.expiryMode,
+		certRuleDeviceCN: &p.deviceCNMode,
+	} {
+		switch *mode {
+		case "", "false":
+			*mode = certModeOff
+		case certModeOff, authModeEnforce, authModeAudit:
+		default:
+			return nil, fmt.Errorf("invalid certificatePolicy.%s.mode [%s], must be one of [%s, %s, %s]",
+				rule, *mode, certModeOff, authModeEnforce, authModeAudit)
+		}
+	}
+	if p.issuerMode != certModeOff && len(p.allowedIssuers) == 0 {
+		return nil, fmt.Errorf("invalid certificatePolicy.issuer.allowed: must not be empty")
+	}
+	if p.expiryDays < 0 {
+		return nil, fmt.Errorf("invalid certificatePolicy.expiry.days [%d], must not be negative", p.expiryDays)
+	}
+	if p.issuerMode == certModeOff && p.expiryMode == certModeOff && p.deviceCNMode == certModeOff {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// check returns every rule the certificate of req violates at now.
+func (p *certificatePolicy) check(req *http.Request, now time.Time) []certViolation {
+	if p == nil {
+		return nil
+	}
+	var violations []certViolation
+	if p.issuerMode != certModeOff {
+		issuer := req.Header.Get(certificateProviderHeader)
+		if !containsFold(p.allowedIssuers, issuer) {
+			violations = append(violations, certViolation{certRuleIssuer, p.issuerMode, certIssuerNotAllowed,
+				fmt.Errorf("issuer [%s] is not allowed", issuer)})
+		}
+	}
+	if p.expiryMode != certModeOff {
+		raw := req.Header.Get(expiryDateHeader)
+		expiry, err := time.Parse(certExpiryLayout, raw)
+		switch {
+		case err != nil:
+			violations = append(violations, certViolation{certRuleExpiry, p.expiryMode, certInvalidExpiry,
+				fmt.Errorf("invalid expiry date [%s]: %v", raw, err)})
+		case !now.Before(expiry):
+			violations = append(violations, certViolation{certRuleExpiry, p.expiryMode, certExpired,
+				fmt.Errorf("certificate expired at %s", expiry.Format(time.RFC3339))})
+		case now.AddDate(0, 0, p.expiryDays).After(expiry):
+			violations = append(violations, certViolation{certRuleExpiry, p.expiryMode, certExpiring,
+				fmt.Errorf("certificate expires at %s, within %d days", expiry.Format(time.RFC3339), p.expiryDays)})
+		}
+	}
+	if p.deviceCNMode != certModeOff {
+		// only devices named by their mac address can be compared
+		deviceName := normalizeDeviceID(req.Header.Get("X-Webpa-Device-Name"))
+		if strings.HasPrefix(deviceName, "mac:") {
+			cn := req.Header.Get(deviceCNHeader)
+			if normalizeDeviceID("mac:"+strings.TrimPrefix(strings.ToLower(cn), "mac:")) != deviceName {
+				violations = append(violations, certViolation{certRuleDeviceCN, p.deviceCNMode, certCNMismatch,
+					fmt.Errorf("device CN [%s] does not match device name [%s]", cn, deviceName)})
+			}
+		}
+	}
+	return violations
+}
+
+// checkCertificate logs and counts the certificate rules a request
+// violates and rejects it with 403 if one of them is enforced.
+func checkCertificate() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := currentConfig()
+			req := c.Request()
+			violations := cfg.certificates.check(req, time.Now())
+			if len(violations) == 0 {
+				return next(c)
+			}
+
+			tenant := cfg.tenants.label(req.Header.Get(tenantHeader))
+			var enforced *certViolation
+			for i, violation := range violations {
+				event := log.Ctx(req.Context()).Warn()
+				if violation.mode == authModeEnforce {
+					event = log.Ctx(req.Context()).Error()
+					if enforced == nil {
+						enforced = &violations[i]
+					}
+				}
+				event.Str("rule", violation.rule).Str("mode", violation.mode).Str("tenant", tenant).
+					Msgf("device certificate violates policy: %v", violation.err)
+				if registry != nil {
+					registry.CertificateViolations.WithLabelValues(violation.rule, violation.reason, violation.mode, tenant).Inc()
+				}
+			}
+			if enforced != nil {
+				return c.JSON(http.StatusForbidden, echo.NewHTTPError(http.StatusForbidden, enforced.reason))
+			}
+			return next(c)
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificatePolicy(t *testing.T, mode string) *certificatePolicy {
+	t.Helper()
+	v := testViper(t, map[string]interface{}{
+		"certificatePolicy.issuer.mode":    mode,
+		"certificatePolicy.issuer.allowed": []string{"DTSECURITY", "C2 Device CA"},
+		"certificatePolicy.expiry.mode":    mode,
+		"certificatePolicy.expiry.days":    30,
+		"certificatePolicy.deviceCN.mode":  mode,
+	})
+	p, err := newCertificatePolicy(loadTestConfig(t, v).CertificatePolicy)
+	require.NoError(t, err)
+	return p
+}
+
+func newTestCertRequest(issuer, expiry, deviceCN, deviceName string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set(certificateProviderHeader, issuer)
+	r.Header.Set(expiryDateHeader, expiry)
+	r.Header.Set(deviceCNHeader, deviceCN)
+	r.Header.Set("X-Webpa-Device-Name", deviceName)
+	return r
+}
+
+func TestCertificatePolicyCheck(t *testing.T) {
+	p := newTestCertificatePolicy(t, authModeEnforce)
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	testData := []struct {
+		issuer     string
+		expiry     string
+		deviceCN   string
+		deviceName string
+		reasons    []string
+	}{
+		{"DTSECURITY", "Sep 19 23:59:59 2031 GMT", "112233445566", "mac:112233445566", nil},
+		{"dtsecurity", "Sep 19 23:59:59 2031 GMT", "11:22:33:AA:BB:CC", "mac:112233aabbcc", nil},
+		{"C2 Device CA", "Feb  1 00:00:00 2026 GMT", "mac:112233445566", "mac:11-22-33-44-55-66", nil},
+		{"DTSECURITY", "Sep 19 23:59:59 2031 GMT", "TestCPE", "serial:1234", nil},
+		{"ROGUE CA", "Sep 19 23:59:59 2031 GMT", "112233445566", "mac:112233445566", []string{certIssuerNotAllowed}},
+		{"", "Sep 19 23:59:59 2031 GMT", "112233445566", "mac:112233445566", []string{certIssuerNotAllowed}},
+		{"DTSECURITY", "Dec 31 23:59:59 2025 GMT", "112233445566", "mac:112233445566", []string{certExpired}},
+		{"DTSECURITY", "Jan 15 00:00:00 2026 GMT", "112233445566", "mac:112233445566", []string{certExpiring}},
+		{"DTSECURITY", "2031-09-19", "112233445566", "mac:112233445566", []string{certInvalidExpiry}},
+		{"DTSECURITY", "Sep 19 23:59:59 2031 GMT", "665544332211", "mac:112233445566", []string{certCNMismatch}},
+		{"DTSECURITY", "Sep 19 23:59:59 2031 GMT", "", "mac:112233445566", []string{certCNMismatch}},
+		{"ROGUE CA", "", "665544332211", "mac:112233445566", []string{certIssuerNotAllowed, certInvalidExpiry, certCNMismatch}},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			violations := p.check(newTestCertRequest(record.issuer, record.expiry, record.deviceCN, record.deviceName), now)
+			var reasons []string
+			for _, violation := range violations {
+				reasons = append(reasons, violation.reason)
+				assert.Equal(t, authModeEnforce, violation.mode)
+			}
+			assert.Equal(t, record.reasons, reasons)
+		})
+	}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	previous := currentConfig()
+	defer current.Store(previous)
+	cfg := *previous
+	current.Store(&cfg)
+
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		handler := checkCertificate()(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		})
+		handler(echo.New().NewContext(r, w))
+		return w.Code
+	}
+	rogue := newTestCertRequest("ROGUE CA", "Sep 19 23:59:59 2031 GMT", "112233445566", "mac:112233445566")
+
+	assert.Equal(t, http.StatusOK, serve(rogue), "certificates are not checked by default")
+	cfg.certificates = newTestCertificatePolicy(t, authModeAudit)
+	assert.Equal(t, http.StatusOK, serve(rogue), "audited violations are let through")
+	cfg.certificates = newTestCertificatePolicy(t, authModeEnforce)
+	assert.Equal(t, http.StatusForbidden, serve(rogue))
+	assert.Equal(t, http.StatusOK, serve(newTestCertRequest("DTSECURITY", "Sep 19 23:59:59 2031 GMT", "112233445566", "mac:112233445566")))
+}
+
+func TestNewCertificatePolicy(t *testing.T) {
+	testData := []struct {
+		settings map[string]interface{}
+		key      string
+	}{
+		{map[string]interface{}{"certificatePolicy.issuer.mode": "reject"}, "certificatePolicy.issuer.mode"},
+		{map[string]interface{}{"certificatePolicy.issuer.mode": authModeAudit}, "certificatePolicy.issuer.allowed"},
+		{map[string]interface{}{"certificatePolicy.expiry.mode": authModeAudit, "certificatePolicy.expiry.days": -1}, "certificatePolicy.expiry.days"},
+		{map[string]interface{}{"certificatePolicy.deviceCN.mode": "on"}, "certificatePolicy.deviceCN.mode"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := newCertificatePolicy(loadTestConfig(t, testViper(t, record.settings)).CertificatePolicy)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), record.key)
+		})
+	}
+
+	v := testViper(t, map[string]interface{}{
+		"certificatePolicy.issuer.mode":   certModeOff,
+		"certificatePolicy.deviceCN.mode": certModeOff,
+	})
+	p, err := newCertificatePolicy(loadTestConfig(t, v).CertificatePolicy)
+	assert.NoError(t, err)
+	assert.Nil(t, p, "every rule is off")
+
+	v.Set("certificatePolicy.deviceCN.mode", authModeAudit)
+	p, err = newCertificatePolicy(loadTestConfig(t, v).CertificatePolicy)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, certModeOff, p.expiryMode)
+
+	// off is the boolean false unless quoted
+	v = viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader("certificatePolicy:\n  issuer:\n    mode: off\n  deviceCN:\n    mode: audit\n")))
+	p, err = newCertificatePolicy(loadTestConfig(t, v).CertificatePolicy)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	assert.Equal(t, certModeOff, p.issuerMode)
+}
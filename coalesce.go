@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// lookups collapses concurrent petasos lookups of the same device.
+var lookups = &lookupGroup{}
+
+type lookupResult struct {
+	redirect *cachedRedirect
+	err      *forwardError
+}
+
+// lookupGroup shares the outcome of a petasos lookup with every request
+// for the same cache key which arrives while the lookup is in flight.
+// Devices reconnecting several times at once are thus redirected by a
+// single petasos call and a single rewrite.
+type lookupGroup struct {
+	group singleflight.Group
+}
+
+// do calls lookup once for concurrent callers with the same key, the
+// waiting callers get its redirect or error. Responses which are
+// streamed to the first caller cannot be shared, lookup returns neither
+// for them as soon as their status is known and waiting callers then
+// make a lookup of their own, just like when the first caller
+// disconnected. Requests without key are never collapsed.
+func (g *lookupGroup) do(key, tenant string, lookup func() (*cachedRedirect, *forwardError)) (*cachedRedirect, *forwardError) {
+	if key == "" {
+		return lookup()
+	}
+
+	var (
+		leader   bool
+		panicked interface{}
+	)
+	v, _, _ := g.group.Do(key, func() (result interface{}, err error) {
+		leader = true
+		// singleflight panics in a new goroutine if others wait,
+		// the panic is raised again below in the leader instead.
+		defer func() {
+			if panicked = recover(); panicked != nil {
+				result = lookupResult{err: newForwardError(errInvalidResponse, fmt.Errorf("petasos lookup failed: %v", panicked))}
+			}
+		}()
+		redirect, ferr := lookup()
+		return lookupResult{redirect: redirect, err: ferr}, nil
+	})
+	if panicked != nil {
+		panic(panicked)
+	}
+
+	r := v.(lookupResult)
+	if leader {
+		return r.redirect, r.err
+	}
+	if r.redirect == nil && (r.err == nil || r.err.Kind == errClientDisconnected) {
+		return lookup()
+	}
+	if registry != nil {
+		registry.CoalescedRequests.WithLabelValues(tenant).Inc()
+	}
+	return r.redirect, r.err
+}
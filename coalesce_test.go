@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupGroupSharesRedirects(t *testing.T) {
+	assert := assert.New(t)
+	g := &lookupGroup{}
+	var calls int32
+	release := make(chan struct{})
+	redirect := &cachedRedirect{status: http.StatusTemporaryRedirect}
+	lookup := func() (*cachedRedirect, *forwardError) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return redirect, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := g.do("device", defaultTenant, lookup)
+			assert.Nil(err)
+			assert.Equal(redirect, r)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestLookupGroupRetriesUnsharedResults(t *testing.T) {
+	testData := []*forwardError{
+		nil,
+		newForwardError(errClientDisconnected, context.Canceled),
+	}
+	for _, record := range testData {
+		assert := assert.New(t)
+		g := &lookupGroup{}
+		var calls int32
+		release := make(chan struct{})
+		lookup := func() (*cachedRedirect, *forwardError) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				<-release
+			}
+			return nil, record
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g.do("device", defaultTenant, lookup)
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.Equal(int32(3), atomic.LoadInt32(&calls))
+	}
+}
+
+func TestLookupGroupWithoutKey(t *testing.T) {
+	g := &lookupGroup{}
+	calls := 0
+	for i := 0; i < 3; i++ {
+		g.do("", defaultTenant, func() (*cachedRedirect, *forwardError) {
+			calls++
+			return &cachedRedirect{}, nil
+		})
+	}
+	assert.Equal(t, 3, calls)
+}
+
+func TestForwarderCoalescesConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		response.Header().Set("Location", "http://xmidt-talaria:6200/api/v2/device")
+		response.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	routeToPetasos(t, server.URL)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 4)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+			r.Header.Set("X-Webpa-Device-Name", "mac:112233445566")
+			responses[i] = httptest.NewRecorder()
+			assert.Nil(forwarder(echo.New().NewContext(r, responses[i]), client))
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	for _, w := range responses {
+		assert.Equal(http.StatusTemporaryRedirect, w.Code)
+		assert.Equal(responses[0].Header().Get("Location"), w.Header().Get("Location"))
+	}
+}
+
+func TestForwarderStreamsOutsideTheLookup(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	headers, body := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-headers
+			response.WriteHeader(http.StatusOK)
+			response.(http.Flusher).Flush()
+			<-body
+		}
+		response.Write([]byte("done"))
+	}))
+	defer server.Close()
+	routeToPetasos(t, server.URL)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 2)
+	forward := func(i int) {
+		defer wg.Done()
+		r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+		r.Header.Set("X-Webpa-Device-Name", "mac:112233445566")
+		responses[i] = httptest.NewRecorder()
+		assert.Nil(forwarder(echo.New().NewContext(r, responses[i]), client))
+	}
+	wg.Add(2)
+	go forward(0)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, 10*time.Millisecond)
+	go forward(1)
+	time.Sleep(50 * time.Millisecond)
+
+	// the waiting request asks petasos itself while the first body is
+	// still being streamed
+	close(headers)
+	assert.Eventually(func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, 10*time.Millisecond)
+	close(body)
+	wg.Wait()
+
+	for _, w := range responses {
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal("done", w.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// confDir is the directory next to the configuration file whose
+// fragments are merged on top of it.
+const confDir = "conf.d"
+
+// fragmentExtensions are the file types merged from conf.d, other files
+// like the ..data links of ConfigMap mounts are ignored.
+var fragmentExtensions = []string{".yaml", ".yml", ".json", ".toml"}
+
+// configFiles returns base followed by the fragments of its conf.d
+// directory in lexical order.
+func configFiles(base string) ([]string, error) {
+	files := []string{base}
+	dir := filepath.Join(filepath.Dir(base), confDir)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s [%s]: %v", confDir, dir, err)
+	}
+	// ReadDir sorts by name
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !isFragment(entry.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	return files, nil
+}
+
+func isFragment(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, fragment := range fragmentExtensions {
+		if ext == fragment {
+			return true
+		}
+	}
+	return false
+}
+
+// readSettings returns every key of file which has a value.
+func readSettings(file string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("reading [%s]: %v", file, err)
+	}
+	settings := make(map[string]interface{})
+	for _, key := range v.AllKeys() {
+		if value := v.Get(key); value != nil {
+			settings[key] = value
+		}
+	}
+	return settings, nil
+}
+
+// mergeFragments merges the conf.d fragments of the configuration file
+// of v on top of it, in lexical order. Maps are merged key by key, any
+// other value, lists included, replaces the one of earlier files. Empty
+// values keep the one of earlier files.
+func mergeFragments(v *viper.Viper) error {
+	files, err := configFiles(v.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+	for _, file := range files[1:] {
+		settings, err := readSettings(file)
+		if err != nil {
+			return err
+		}
+		for key, value := range settings {
+			v.Set(key, value)
+		}
+	}
+	return nil
+}
+
+// fileSources returns the file each key of the configuration file of v
+// and its fragments is taken from.
+func fileSources(v *viper.Viper) (map[string]string, error) {
+	sources := make(map[string]string)
+	if v.ConfigFileUsed() == "" {
+		return sources, nil
+	}
+	files, err := configFiles(v.ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		settings, err := readSettings(file)
+		if err != nil {
+			return nil, err
+		}
+		for key := range settings {
+			sources[key] = sourceFile + ":" + file
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConfD writes the base configuration and the given conf.d
+// fragments, the path of the base file is returned.
+func newTestConfD(t *testing.T, base string, fragments map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "confd")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "petasos-rewriter.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(base), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, confDir), 0755))
+	for name, content := range fragments {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, confDir, name), []byte(content), 0644))
+	}
+	return file
+}
+
+func TestConfigFiles(t *testing.T) {
+	file := newTestConfD(t, "", map[string]string{
+		"20-b.json":   "{}",
+		"10-a.yaml":   "",
+		"30-c.toml":   "",
+		"notes.txt":   "",
+		".hidden.yml": "",
+	})
+	require.NoError(t, os.Mkdir(filepath.Join(filepath.Dir(file), confDir, "sub.yaml"), 0755))
+
+	files, err := configFiles(file)
+	require.NoError(t, err)
+	dir := filepath.Join(filepath.Dir(file), confDir)
+	assert.Equal(t, []string{
+		file,
+		filepath.Join(dir, "10-a.yaml"),
+		filepath.Join(dir, "20-b.json"),
+		filepath.Join(dir, "30-c.toml"),
+	}, files)
+
+	files, err = configFiles(filepath.Join(os.TempDir(), "missing", "petasos-rewriter.yaml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "conf.d is optional")
+}
+
+func TestReadConfigMergesFragments(t *testing.T) {
+	assert := assert.New(t)
+	base := `
+server:
+  fixedScheme:
+talaria:
+  domain: example.com
+  rules:
+    - match: ^a$
+      replace: a
+    - match: ^b$
+      replace: b
+tenants:
+  acme:
+    petasos:
+      endpoint: http://petasos-acme:6400
+    talaria:
+      domain: acme.example.com
+`
+	file := newTestConfD(t, base, map[string]string{
+		"10-env.yaml": "server:\n  fixedScheme: https\ntalaria:\n  rules:\n    - match: ^c$\n      replace: c\n",
+		"20-tenant.json": `{"tenants": {"acme": {"petasos": {"endpoint": "http://petasos-acme-2:6400"}},
+			"globex": {"talaria": {"domain": "globex.com"}}}}`,
+		"30-cache.toml": "[cache]\nmaxSize = 10\n",
+	})
+	setTestEnv(t, "PETASOS_REWRITER_CACHE_MAXSIZE", "20")
+
+	v := viper.New()
+	require.NoError(t, readConfig(v, file, nil))
+	assert.Equal("https", v.GetString("server.fixedScheme"), "later files win")
+	assert.Equal("example.com", v.GetString("talaria.domain"), "maps are merged")
+	assert.Len(v.Get("talaria.rules"), 1, "lists are replaced")
+	assert.Equal("http://petasos-acme-2:6400", v.GetString("tenants.acme.petasos.endpoint"))
+	assert.Equal("acme.example.com", v.GetString("tenants.acme.talaria.domain"))
+	assert.Equal("globex.com", v.Sub("tenants.globex").GetString("talaria.domain"))
+	assert.Equal(20, v.GetInt("cache.maxSize"), "the environment wins over fragments")
+
+	sources, err := valueSources(v, nil)
+	require.NoError(t, err)
+	dir := filepath.Join(filepath.Dir(file), confDir)
+	assert.Equal(sourceFile+":"+filepath.Join(dir, "10-env.yaml"), sources["server.fixedscheme"])
+	assert.Equal(sourceFile+":"+file, sources["talaria.domain"])
+	assert.Equal(sourceFile+":"+filepath.Join(dir, "20-tenant.json"), sources["tenants.globex.talaria.domain"])
+	assert.Equal(sourceEnv, sources["cache.maxsize"])
+}
+
+func TestConfigReloaderWatchesConfD(t *testing.T) {
+	r, file := newTestReloader(t, "https")
+	dir := filepath.Join(filepath.Dir(file), confDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, r.start())
+	defer r.stop()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10-scheme.yaml"), []byte("server:\n  fixedScheme: http\n"), 0644))
+	assert.Eventually(t, func() bool {
+		return currentConfig().fixedScheme == "http"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConfigReloaderDebouncesConfD(t *testing.T) {
+	defer func(r *metricRegistry) { registry = r }(registry)
+	registry = registerMetrics(MetricsConfig{})
+	reloads := registry.ConfigReloads.WithLabelValues(reloadTriggerFile, "success")
+
+	r, file := newTestReloader(t, "https")
+	dir := filepath.Join(filepath.Dir(file), confDir)
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, r.start())
+	defer r.stop()
+
+	// writing a fragment creates and writes it, both are one reload
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10-scheme.yaml"), []byte("server:\n  fixedScheme: http\n"), 0644))
+	require.Eventually(t, func() bool {
+		return currentConfig().fixedScheme == "http"
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(2 * watchDebounce)
+	assert.Equal(t, float64(1), testutil.ToFloat64(reloads))
+}
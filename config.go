@@ -0,0 +1,668 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Triggers of a configuration reload
+const (
+	reloadTriggerFile      = "file"
+	reloadTriggerSignal    = "signal"
+	reloadTriggerDiscovery = "discovery"
+	reloadTriggerAdmin     = "admin"
+)
+
+// restartSections are only read at startup, changing them needs a restart.
+var restartSections = []string{"server.port", "metricsOptions", "log", "sentry", "traceProvider", "upstream", "cache", "discovery"}
+
+// Config holds the settings of every section. The routing sections,
+// petasos, talaria, remoteUpdate and circuitBreaker, can be overridden
+// per tenant: every Tenants entry holds them with the overrides of the
+// tenant applied. Sections with a constructor are validated by it.
+type Config struct {
+	Server            ServerConfig `mapstructure:"server"`
+	RoutingConfig     `mapstructure:",squash"`
+	Redirect          RedirectConfig           `mapstructure:"redirect"`
+	Tenancy           TenancyConfig            `mapstructure:"tenancy"`
+	Tenants           map[string]RoutingConfig `mapstructure:"tenants"`
+	Upstream          UpstreamConfig           `mapstructure:"upstream"`
+	Cache             CacheConfig              `mapstructure:"cache"`
+	Authorization     AuthorizationConfig      `mapstructure:"authorization"`
+	CertificatePolicy CertificatePolicyConfig  `mapstructure:"certificatePolicy"`
+	Discovery         DiscoveryConfig          `mapstructure:"discovery"`
+	Sentry            SentryConfig             `mapstructure:"sentry"`
+	Log               LogConfig                `mapstructure:"log"`
+	TraceProvider     TraceProviderConfig      `mapstructure:"traceProvider"`
+	MetricsOptions    MetricsConfig            `mapstructure:"metricsOptions"`
+}
+
+type ServerConfig struct {
+	Port        int    `mapstructure:"port"`
+	FixedScheme string `mapstructure:"fixedScheme"`
+	AuthHeader  struct {
+		Check struct {
+			Enabled     bool   `mapstructure:"enabled"`
+			Mode        string `mapstructure:"mode"`
+			RequestPath string `mapstructure:"requestPath"`
+		} `mapstructure:"check"`
+		JWT      JWTConfig    `mapstructure:"jwt"`
+		Policies authPolicies `mapstructure:"policies"`
+	} `mapstructure:"authHeader"`
+}
+
+// RoutingConfig holds the sections a tenant can override.
+type RoutingConfig struct {
+	Petasos        PetasosConfig         `mapstructure:"petasos"`
+	Talaria        TalariaConfig         `mapstructure:"talaria"`
+	RemoteUpdate   RemoteUpdateConfig    `mapstructure:"remoteUpdate"`
+	CircuitBreaker CircuitBreakersConfig `mapstructure:"circuitBreaker"`
+}
+
+type PetasosConfig struct {
+	Mode      string   `mapstructure:"mode"`
+	Endpoint  string   `mapstructure:"endpoint"`
+	Endpoints []string `mapstructure:"endpoints"`
+	Balancer  struct {
+		Strategy string `mapstructure:"strategy"`
+	} `mapstructure:"balancer"`
+	Ejection struct {
+		ConsecutiveFailures int           `mapstructure:"consecutiveFailures"`
+		Duration            time.Duration `mapstructure:"duration"`
+	} `mapstructure:"ejection"`
+}
+
+type TalariaConfig struct {
+	Internal  string        `mapstructure:"internal"`
+	External  string        `mapstructure:"external"`
+	Domain    string        `mapstructure:"domain"`
+	Rules     []mappingRule `mapstructure:"rules"`
+	Unmatched struct {
+		Policy  string        `mapstructure:"policy"`
+		Default mappingTarget `mapstructure:"default"`
+	} `mapstructure:"unmatched"`
+	Port struct {
+		Policy string         `mapstructure:"policy"`
+		Map    map[string]int `mapstructure:"map"`
+	} `mapstructure:"port"`
+	Instances     []string `mapstructure:"instances"`
+	InstancesFile string   `mapstructure:"instancesFile"`
+	VnodeCount    int      `mapstructure:"vnodeCount"`
+}
+
+type RemoteUpdateConfig struct {
+	Enable bool   `mapstructure:"enable"`
+	URL    string `mapstructure:"url"`
+}
+
+// CircuitBreakersConfig holds a breaker per upstream.
+type CircuitBreakersConfig struct {
+	Petasos        CircuitBreakerConfig `mapstructure:"petasos"`
+	ResourceUpdate CircuitBreakerConfig `mapstructure:"resourceUpdate"`
+}
+
+type CircuitBreakerConfig struct {
+	Enabled              bool          `mapstructure:"enabled"`
+	FailureRateThreshold float64       `mapstructure:"failureRateThreshold"`
+	SlowCallThreshold    time.Duration `mapstructure:"slowCallThreshold"`
+	MinRequests          int           `mapstructure:"minRequests"`
+	Window               time.Duration `mapstructure:"window"`
+	CoolDown             time.Duration `mapstructure:"coolDown"`
+	HalfOpenProbes       int           `mapstructure:"halfOpenProbes"`
+}
+
+type RedirectConfig struct {
+	StatusCodes         []int `mapstructure:"statusCodes"`
+	NormalizeStatusCode int   `mapstructure:"normalizeStatusCode"`
+}
+
+type TenancyConfig struct {
+	UnknownTenant string `mapstructure:"unknownTenant"`
+}
+
+type UpstreamConfig struct {
+	Client UpstreamClientConfig `mapstructure:"client"`
+}
+
+// UpstreamClientConfig has no defaults, settings which are not set keep
+// the ones of http.DefaultTransport.
+type UpstreamClientConfig struct {
+	DialTimeout           time.Duration `mapstructure:"dialTimeout"`
+	KeepAlive             time.Duration `mapstructure:"keepAlive"`
+	TLSHandshakeTimeout   time.Duration `mapstructure:"tlsHandshakeTimeout"`
+	ResponseHeaderTimeout time.Duration `mapstructure:"responseHeaderTimeout"`
+	MaxIdleConns          int           `mapstructure:"maxIdleConns"`
+	MaxIdleConnsPerHost   int           `mapstructure:"maxIdleConnsPerHost"`
+	IdleConnTimeout       time.Duration `mapstructure:"idleConnTimeout"`
+	RequestTimeout        time.Duration `mapstructure:"requestTimeout"`
+}
+
+type CacheConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	TTL      time.Duration `mapstructure:"ttl"`
+	MaxStale time.Duration `mapstructure:"maxStale"`
+	MaxSize  int           `mapstructure:"maxSize"`
+}
+
+type AuthorizationConfig struct {
+	CapabilitiesClaim string              `mapstructure:"capabilitiesClaim"`
+	Rules             []authorizationRule `mapstructure:"rules"`
+}
+
+type CertificatePolicyConfig struct {
+	Issuer struct {
+		Mode    string   `mapstructure:"mode"`
+		Allowed []string `mapstructure:"allowed"`
+	} `mapstructure:"issuer"`
+	Expiry struct {
+		Mode string `mapstructure:"mode"`
+		Days int    `mapstructure:"days"`
+	} `mapstructure:"expiry"`
+	DeviceCN struct {
+		Mode string `mapstructure:"mode"`
+	} `mapstructure:"deviceCN"`
+}
+
+type DiscoveryConfig struct {
+	File string `mapstructure:"file"`
+}
+
+type SentryConfig struct {
+	DSN         string `mapstructure:"dsn"`
+	Environment string `mapstructure:"environment"`
+	Debug       bool   `mapstructure:"debug"`
+}
+
+type LogConfig struct {
+	Type       string `mapstructure:"type"`
+	JSON       bool   `mapstructure:"json"`
+	Level      string `mapstructure:"level"`
+	Dir        string `mapstructure:"dir"`
+	FileName   string `mapstructure:"fileName"`
+	MaxSize    int    `mapstructure:"maxSize"`
+	MaxAge     int    `mapstructure:"maxAge"`
+	MaxBackups int    `mapstructure:"maxBackups"`
+}
+
+type TraceProviderConfig struct {
+	Type            string `mapstructure:"type"`
+	Endpoint        string `mapstructure:"endpoint"`
+	SkipTraceExport bool   `mapstructure:"skipTraceExport"`
+}
+
+type MetricsConfig struct {
+	Port      int    `mapstructure:"port"`
+	Namespace string `mapstructure:"namespace"`
+	Subsystem string `mapstructure:"subsystem"`
+	// AdminReload serves the unauthenticated reload API on the metrics
+	// port, which then must not be reachable from outside.
+	AdminReload bool `mapstructure:"adminReload"`
+}
+
+// setConfigDefaults sets the defaults of the Config keys.
+func setConfigDefaults(v *viper.Viper) {
+	v.SetDefault("server.port", 1323)
+	v.SetDefault("server.authHeader.check.mode", authModeEnforce)
+	v.SetDefault("server.authHeader.jwt.clockSkew", "30s")
+	v.SetDefault("petasos.mode", petasosModeUpstream)
+	v.SetDefault("petasos.balancer.strategy", roundRobin)
+	v.SetDefault("petasos.ejection.consecutiveFailures", defaultConsecutiveFailures)
+	v.SetDefault("petasos.ejection.duration", defaultEjectionDuration)
+	v.SetDefault("talaria.unmatched.policy", unmatchedError)
+	v.SetDefault("talaria.port.policy", portDrop)
+	v.SetDefault("talaria.vnodeCount", defaultVnodeCount)
+	for _, upstream := range []string{upstreamPetasos, upstreamResourceUpdate} {
+		key := "circuitBreaker." + upstream + "."
+		v.SetDefault(key+"failureRateThreshold", defaultFailureRateThreshold)
+		v.SetDefault(key+"minRequests", defaultMinRequests)
+		v.SetDefault(key+"window", defaultBreakerWindow)
+		v.SetDefault(key+"coolDown", defaultCoolDown)
+		v.SetDefault(key+"halfOpenProbes", defaultHalfOpenProbes)
+	}
+	v.SetDefault("redirect.statusCodes", defaultRedirectStatusCodes)
+	v.SetDefault("tenancy.unknownTenant", unknownTenantDefault)
+	v.SetDefault("cache.ttl", defaultCacheTTL)
+	v.SetDefault("cache.maxSize", defaultCacheMaxSize)
+	v.SetDefault("authorization.capabilitiesClaim", defaultCapabilitiesClaim)
+	v.SetDefault("certificatePolicy.issuer.mode", certModeOff)
+	v.SetDefault("certificatePolicy.expiry.mode", certModeOff)
+	v.SetDefault("certificatePolicy.deviceCN.mode", certModeOff)
+	v.SetDefault("sentry.dsn", sentryDisabled)
+	v.SetDefault("log.type", "stdout")
+	v.SetDefault("log.level", "debug")
+	v.SetDefault("log.fileName", applicationName+".log")
+	v.SetDefault("traceProvider.type", stdoutName)
+	v.SetDefault("metricsOptions.port", 1324)
+	v.SetDefault("metricsOptions.namespace", "xmidt")
+	v.SetDefault("metricsOptions.subsystem", "petasos_rewriter")
+}
+
+// loadConfig reads the Config of v, the error names the offending key.
+func loadConfig(v *viper.Viper) (*Config, error) {
+	setConfigDefaults(v)
+	c := &Config{}
+	if err := decodeConfig(v, c); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	// the decoded tenants only hold their overrides
+	for id := range c.Tenants {
+		var tenant RoutingConfig
+		if err := decodeConfig(routingSettings(v, v.Sub("tenants."+id)), &tenant); err != nil {
+			return nil, fmt.Errorf("invalid tenants.%s: %v", id, err)
+		}
+		c.Tenants[id] = tenant
+	}
+	if c.TraceProvider.Type == jaegarName {
+		log.Warn().Msgf("traceProvider.type [%s] is deprecated, use [%s]", jaegarName, jaegerName)
+		c.TraceProvider.Type = jaegerName
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if err := validatePort("server.port", c.Server.Port); err != nil {
+		return err
+	}
+	switch c.Server.FixedScheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("invalid server.fixedScheme [%s], must be one of [http, https]", c.Server.FixedScheme)
+	}
+
+	switch c.Server.AuthHeader.Check.Mode {
+	case authModeEnforce, authModeAudit:
+	default:
+		return fmt.Errorf("invalid server.authHeader.check.mode [%s], must be one of [%s, %s]",
+			c.Server.AuthHeader.Check.Mode, authModeEnforce, authModeAudit)
+	}
+	if c.Server.AuthHeader.JWT.ClockSkew < 0 {
+		return fmt.Errorf("invalid server.authHeader.jwt.clockSkew [%s], must not be negative", c.Server.AuthHeader.JWT.ClockSkew)
+	}
+
+	if c.RemoteUpdate.Enable || c.RemoteUpdate.URL != "" {
+		if _, err := parseRemoteUpdateURL(c.RemoteUpdate.URL); err != nil {
+			return err
+		}
+	}
+
+	switch c.Log.Type {
+	case "stdout":
+	case "file":
+		if c.Log.Dir == "" || c.Log.FileName == "" {
+			return fmt.Errorf("invalid log.type [file]: log.dir and log.fileName are required")
+		}
+	default:
+		return fmt.Errorf("invalid log.type [%s], must be one of [stdout, file]", c.Log.Type)
+	}
+	switch c.Log.Level {
+	case zerolog.DebugLevel.String(), zerolog.InfoLevel.String(), zerolog.ErrorLevel.String():
+	default:
+		return fmt.Errorf("invalid log.level [%s], must be one of [debug, info, error]", c.Log.Level)
+	}
+
+	switch c.TraceProvider.Type {
+	case stdoutName, noopName:
+	case jaegerName, zipkinName:
+		if c.TraceProvider.Endpoint == "" {
+			return fmt.Errorf("invalid traceProvider.type [%s]: traceProvider.endpoint is required", c.TraceProvider.Type)
+		}
+	default:
+		return fmt.Errorf("invalid traceProvider.type [%s], must be one of [%s, %s, %s, %s]",
+			c.TraceProvider.Type, stdoutName, jaegerName, zipkinName, noopName)
+	}
+
+	if err := validatePort("metricsOptions.port", c.MetricsOptions.Port); err != nil {
+		return err
+	}
+	if c.MetricsOptions.Port == c.Server.Port {
+		return fmt.Errorf("invalid metricsOptions.port [%d]: server.port is the same", c.MetricsOptions.Port)
+	}
+	return nil
+}
+
+// decodeConfig decodes the settings of v into c. Unquoted YAML booleans
+// like off are decoded to the strings viper.GetString returns for them,
+// weak decoding would turn them into 0 and 1.
+func decodeConfig(v *viper.Viper, c interface{}) error {
+	return v.Unmarshal(c, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		func(from, to reflect.Type, data interface{}) (interface{}, error) {
+			if from.Kind() == reflect.Bool && to.Kind() == reflect.String {
+				return strconv.FormatBool(data.(bool)), nil
+			}
+			return data, nil
+		},
+	)))
+}
+
+func validatePort(key string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid %s [%d], must be between 1 and 65535", key, port)
+	}
+	return nil
+}
+
+// parseRemoteUpdateURL parses remoteUpdate.url, the resource update
+// service is called with the device appended to its path.
+func parseRemoteUpdateURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remoteUpdate.url: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid remoteUpdate.url [%s]: scheme and host are required", raw)
+	}
+	return u, nil
+}
+
+// validateConfig builds everything the configuration of v describes
+// without starting anything, it is used by the validate-config command.
+func validateConfig(v *viper.Viper) error {
+	config, err := loadConfig(v)
+	if err != nil {
+		return err
+	}
+	cfg, err := newRuntimeConfig(v, newDiscovery(config.Discovery))
+	if err != nil {
+		return err
+	}
+	defer cfg.close()
+	if _, err := newRedirectCache(config.Cache); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runtimeConfig is everything requests read from the configuration. It is
+// built and validated as a whole and swapped atomically, a request keeps
+// the snapshot it started with.
+type runtimeConfig struct {
+	v      *viper.Viper
+	config *Config
+
+	authHeaderCheckEnabled bool
+	authHeaderCheckAudit   bool
+	authPolicies           authPolicies
+	fixedScheme            string
+	redirects              *redirectPolicy
+	tenants                *tenantRouter
+	// jwt validates bearer tokens if the auth header check is enabled
+	// and a JWKS file is configured
+	jwt          *jwtValidator
+	authorizer   *authorizer
+	certificates *certificatePolicy
+}
+
+var current atomic.Value
+
+// currentConfig returns the configuration in use. Until one is applied,
+// redirects are handled with the default policy.
+func currentConfig() *runtimeConfig {
+	if cfg, ok := current.Load().(*runtimeConfig); ok {
+		return cfg
+	}
+	return &runtimeConfig{v: viper.New(), redirects: newDefaultRedirectPolicy()}
+}
+
+// applyConfig swaps cfg in and releases the previous configuration. The
+// state of its breakers and petasos backends is carried over.
+func applyConfig(cfg *runtimeConfig) {
+	previous, _ := current.Load().(*runtimeConfig)
+	var tenants *tenantRouter
+	if previous != nil {
+		tenants = previous.tenants
+	}
+	cfg.tenants.inherit(tenants)
+	current.Store(cfg)
+	if previous != nil {
+		previous.close()
+	}
+}
+
+// close stops watching the files of cfg.
+func (cfg *runtimeConfig) close() {
+	cfg.tenants.close()
+	cfg.jwt.close()
+}
+
+// newRuntimeConfig parses and validates v, the tenants are built with the
+// endpoints of d on top if discovery is configured.
+func newRuntimeConfig(v *viper.Viper, d *discovery) (*runtimeConfig, error) {
+	config, err := loadConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &runtimeConfig{
+		v:                      v,
+		config:                 config,
+		authHeaderCheckEnabled: config.Server.AuthHeader.Check.Enabled,
+		authHeaderCheckAudit:   config.Server.AuthHeader.Check.Mode == authModeAudit,
+		fixedScheme:            config.Server.FixedScheme,
+	}
+
+	cfg.redirects, err = newRedirectPolicy(config.Redirect)
+	if err != nil {
+		return nil, err
+	}
+	cfg.authPolicies, err = newAuthPolicies(config)
+	if err != nil {
+		return nil, err
+	}
+	cfg.certificates, err = newCertificatePolicy(config.CertificatePolicy)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.authHeaderCheckEnabled {
+		cfg.jwt, err = newJWTValidator(config.Server.AuthHeader.JWT)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.authorizer, err = newAuthorizer(config.Authorization)
+	if err == nil && cfg.authorizer != nil && cfg.jwt == nil {
+		err = fmt.Errorf("invalid authorization.rules: server.authHeader.check.enabled and server.authHeader.jwt.jwksFile are required")
+	}
+	if err != nil {
+		cfg.jwt.close()
+		return nil, err
+	}
+	if d != nil {
+		cfg.tenants, err = d.tenantRouter(v)
+	} else {
+		cfg.tenants, err = newTenantRouter(config)
+	}
+	if err != nil {
+		cfg.jwt.close()
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reloadStatus is the outcome of the last reload, shown by the admin API.
+type reloadStatus struct {
+	Trigger string    `json:"trigger"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// configReloader reloads the configuration file and its conf.d fragments
+// on change, on SIGHUP, when the discovery file changes and when asked by
+// the admin API. An invalid configuration is rejected and the one in use
+// is kept.
+type configReloader struct {
+	file      string
+	discovery *discovery
+	flags     *pflag.FlagSet
+	stops     []func()
+
+	mu   sync.Mutex
+	last *reloadStatus
+}
+
+// reloader is set once hot reload is started.
+var reloader *configReloader
+
+// newConfigReloader reloads file, flags keep winning over it.
+func newConfigReloader(file string, d *discovery, flags *pflag.FlagSet) *configReloader {
+	return &configReloader{file: file, discovery: d, flags: flags}
+}
+
+// start watches the configuration and the discovery file and listens for
+// SIGHUP.
+func (r *configReloader) start() error {
+	stop, err := watchFile(r.file, func() { r.reload(reloadTriggerFile) })
+	if err != nil {
+		return fmt.Errorf("watching configuration [%s]: %v", r.file, err)
+	}
+	r.stops = append(r.stops, stop)
+
+	// fragments are watched if the conf.d directory exists at startup
+	dir := filepath.Join(filepath.Dir(r.file), confDir)
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		stop, err := watchDir(dir, func() { r.reload(reloadTriggerFile) })
+		if err != nil {
+			return fmt.Errorf("watching %s [%s]: %v", confDir, dir, err)
+		}
+		r.stops = append(r.stops, stop)
+	}
+
+	if r.discovery != nil {
+		stop, err := watchFile(r.discovery.file, func() { r.reload(reloadTriggerDiscovery) })
+		if err != nil {
+			return fmt.Errorf("invalid discovery.file: %v", err)
+		}
+		r.stops = append(r.stops, stop)
+		if registry != nil {
+			registry.DiscoveryLastReload.Set(float64(r.discovery.lastReloadTime().Unix()))
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				r.reload(reloadTriggerSignal)
+			case <-done:
+				signal.Stop(signals)
+				return
+			}
+		}
+	}()
+	r.stops = append(r.stops, func() { close(done) })
+	return nil
+}
+
+// stop ends watching and listening for SIGHUP.
+func (r *configReloader) stop() {
+	for _, stop := range r.stops {
+		stop()
+	}
+}
+
+// reload reads, validates and applies the configuration file.
+func (r *configReloader) reload(trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.load()
+	status := &reloadStatus{Trigger: trigger, Success: err == nil, Time: time.Now()}
+	r.last = status
+
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+		status.Error = err.Error()
+		log.Error().Str("trigger", trigger).Msgf("keeping configuration, reload failed: %v", err)
+	} else {
+		log.Info().Str("trigger", trigger).Msgf("configuration reloaded from [%s]", r.file)
+	}
+	if registry != nil {
+		registry.ConfigReloads.WithLabelValues(trigger, outcome).Inc()
+		if trigger == reloadTriggerDiscovery {
+			if err != nil {
+				registry.DiscoveryReloadErrors.Inc()
+			} else {
+				registry.DiscoveryLastReload.SetToCurrentTime()
+			}
+		}
+	}
+	return err
+}
+
+func (r *configReloader) load() error {
+	v := viper.New()
+	if err := readConfig(v, r.file, r.flags); err != nil {
+		return err
+	}
+	cfg, err := newRuntimeConfig(v, r.discovery)
+	if err != nil {
+		return err
+	}
+
+	previous := currentConfig()
+	for _, section := range restartSections {
+		if !reflect.DeepEqual(previous.v.Get(section), v.Get(section)) {
+			log.Warn().Msgf("changes of [%s] are only applied after a restart", section)
+		}
+	}
+	applyConfig(cfg)
+	return nil
+}
+
+// status returns the outcome of the last reload, nil if there was none.
+func (r *configReloader) status() *reloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// reloadStatusHandler shows the outcome of the last reload.
+func reloadStatusHandler(c echo.Context) error {
+	if reloader == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	status := reloader.status()
+	if status == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// reloadHandler reloads the configuration, an invalid one is answered
+// with 422 and the configuration in use is kept.
+func reloadHandler(c echo.Context) error {
+	if reloader == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	err := reloader.reload(reloadTriggerAdmin)
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusUnprocessableEntity
+	}
+	return c.JSON(status, reloader.status())
+}
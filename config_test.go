@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+server:
+  fixedScheme: %s
+petasos:
+  endpoint: http://petasos:6400
+talaria:
+  internal: talaria
+  domain: example.com
+`
+
+// newTestReloader writes a configuration with the given fixedScheme and
+// applies it, the previous configuration is restored after the test.
+func newTestReloader(t *testing.T, fixedScheme string) (*configReloader, string) {
+	t.Helper()
+	previous := currentConfig()
+	t.Cleanup(func() { applyConfig(previous) })
+
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "petasos-rewriter.yaml")
+	writeTestConfig(t, file, fixedScheme)
+
+	r := newConfigReloader(file, nil, nil)
+	require.NoError(t, r.reload(reloadTriggerSignal))
+	return r, file
+}
+
+// testViper returns a viper holding settings, the keys are the full ones
+// like petasos.endpoint.
+func testViper(t *testing.T, settings map[string]interface{}) *viper.Viper {
+	t.Helper()
+	v := viper.New()
+	for key, value := range settings {
+		v.Set(key, value)
+	}
+	return v
+}
+
+// loadTestConfig loads the Config of v, keys which are not set have their
+// defaults.
+func loadTestConfig(t *testing.T, v *viper.Viper) *Config {
+	t.Helper()
+	c, err := loadConfig(v)
+	require.NoError(t, err)
+	return c
+}
+
+func writeTestConfig(t *testing.T, file string, fixedScheme string) {
+	t.Helper()
+	require.NoError(t, ioutil.WriteFile(file, []byte(fmt.Sprintf(testConfig, fixedScheme)), 0644))
+}
+
+func TestNewRuntimeConfig(t *testing.T) {
+	assert := assert.New(t)
+	v := testViper(t, map[string]interface{}{
+		"petasos.endpoint":                    "http://petasos:6400",
+		"talaria.internal":                    "talaria",
+		"server.authHeader.check.enabled":     true,
+		"server.authHeader.check.requestPath": "/api/v2/device",
+	})
+
+	cfg, err := newRuntimeConfig(v, nil)
+	require.NoError(t, err)
+	assert.True(cfg.authHeaderCheckEnabled)
+	assert.Equal(authPresence, cfg.authPolicies.lookup(httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)))
+	assert.Equal(authNone, cfg.authPolicies.lookup(httptest.NewRequest(http.MethodGet, "/v2/api/device", nil)))
+	assert.NotNil(cfg.redirects)
+	assert.NotNil(cfg.tenants)
+
+	v.Set("server.fixedScheme", "ftp")
+	_, err = newRuntimeConfig(v, nil)
+	assert.Error(err)
+}
+
+func TestConfigReloaderKeepsConfigOnFailure(t *testing.T) {
+	assert := assert.New(t)
+	r, file := newTestReloader(t, "https")
+	assert.Equal("https", currentConfig().fixedScheme)
+
+	writeTestConfig(t, file, "http")
+	assert.NoError(r.reload(reloadTriggerSignal))
+	assert.Equal("http", currentConfig().fixedScheme)
+
+	writeTestConfig(t, file, "ftp")
+	assert.Error(r.reload(reloadTriggerSignal))
+	assert.Equal("http", currentConfig().fixedScheme, "an invalid configuration keeps the one in use")
+	status := r.status()
+	assert.False(status.Success)
+	assert.Equal(reloadTriggerSignal, status.Trigger)
+	assert.Contains(status.Error, "ftp")
+}
+
+func TestConfigReloaderWatchesFile(t *testing.T) {
+	r, file := newTestReloader(t, "https")
+	require.NoError(t, r.start())
+	defer r.stop()
+
+	writeTestConfig(t, file, "http")
+	assert.Eventually(t, func() bool {
+		return currentConfig().fixedScheme == "http"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReloadHandler(t *testing.T) {
+	assert := assert.New(t)
+	defer func(r *configReloader) { reloader = r }(reloader)
+	var file string
+	reloader, file = newTestReloader(t, "https")
+
+	w := httptest.NewRecorder()
+	assert.NoError(reloadHandler(echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/admin/config/reload", nil), w)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	writeTestConfig(t, file, "ftp")
+	w = httptest.NewRecorder()
+	assert.NoError(reloadHandler(echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/admin/config/reload", nil), w)))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.NoError(reloadStatusHandler(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/admin/config/reload", nil), w)))
+	assert.Equal(http.StatusOK, w.Code)
+	var status reloadStatus
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(reloadTriggerAdmin, status.Trigger)
+	assert.False(status.Success)
+}
+
+func TestLoadConfig(t *testing.T) {
+	testData := []struct {
+		settings map[string]interface{}
+		key      string
+	}{
+		{map[string]interface{}{}, ""},
+		{map[string]interface{}{"server.port": 0}, "server.port"},
+		{map[string]interface{}{"server.fixedScheme": "ftp"}, "server.fixedScheme"},
+		{map[string]interface{}{"server.authHeader.jwt.clockSkew": "-1s"}, "server.authHeader.jwt.clockSkew"},
+		{map[string]interface{}{"server.authHeader.check.mode": "shadow"}, "server.authHeader.check.mode"},
+		{map[string]interface{}{"remoteUpdate.url": "localhost:9090/resource"}, "remoteUpdate.url"},
+		{map[string]interface{}{"remoteUpdate.enable": true}, "remoteUpdate.url"},
+		{map[string]interface{}{"log.type": "syslog"}, "log.type"},
+		{map[string]interface{}{"log.level": "trace"}, "log.level"},
+		{map[string]interface{}{"traceProvider.type": "jeager"}, "traceProvider.type"},
+		{map[string]interface{}{"traceProvider.type": jaegerName}, "traceProvider.endpoint"},
+		{map[string]interface{}{"metricsOptions.port": 1323}, "metricsOptions.port"},
+		{map[string]interface{}{"server.port": "not a port"}, "port"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c, err := loadConfig(testViper(t, record.settings))
+			if record.key == "" {
+				require.NoError(t, err)
+				assert.Equal(t, 1323, c.Server.Port)
+				assert.Equal(t, 1324, c.MetricsOptions.Port)
+				assert.False(t, c.MetricsOptions.AdminReload, "the admin API is opt-in")
+				assert.Equal(t, stdoutName, c.TraceProvider.Type)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), record.key)
+		})
+	}
+}
+
+func TestLoadConfigAcceptsJaegar(t *testing.T) {
+	v := testViper(t, map[string]interface{}{
+		"traceProvider.type":     jaegarName,
+		"traceProvider.endpoint": "http://jaeger:14268/api/traces",
+	})
+	c, err := loadConfig(v)
+	require.NoError(t, err)
+	assert.Equal(t, jaegerName, c.TraceProvider.Type)
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "petasos-rewriter.yaml")
+
+	writeTestConfig(t, file, "https")
+	rootCmd.SetArgs([]string{"validate-config", "--file", file})
+	assert.NoError(t, rootCmd.Execute())
+
+	writeTestConfig(t, file, "ftp")
+	rootCmd.SetArgs([]string{"validate-config", "--file", file})
+	assert.Error(t, rootCmd.Execute())
+
+	content := fmt.Sprintf(testConfig, "https") + "remoteUpdate:\n  url: localhost:9090/resource\n"
+	require.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+	rootCmd.SetArgs([]string{"validate-config", "--file", file})
+	assert.Error(t, rootCmd.Execute())
+}
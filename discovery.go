@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// discovery overlays the petasos, talaria and tenants sections of the
+// configuration with the ones of an endpoints file, for example rendered
+// by a sidecar or mounted from a ConfigMap. Whenever the file changes the
+// configuration is reloaded, an invalid file keeps the one in use.
+type discovery struct {
+	file string
+
+	mu         sync.Mutex
+	settings   map[string]interface{}
+	lastReload time.Time
+}
+
+// newDiscovery reads the `discovery` section, nil is returned if no
+// discovery.file is configured.
+func newDiscovery(c DiscoveryConfig) *discovery {
+	if c.File == "" {
+		return nil
+	}
+	return &discovery{file: c.File}
+}
+
+// tenantRouter returns the routings of root with the discovered
+// endpoints on top.
+func (d *discovery) tenantRouter(root *viper.Viper) (*tenantRouter, error) {
+	settings, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+
+	merged := viper.New()
+	for _, key := range root.AllKeys() {
+		merged.Set(key, root.Get(key))
+	}
+	for key, value := range settings {
+		merged.Set(key, value)
+	}
+	var t *tenantRouter
+	c, err := loadConfig(merged)
+	if err == nil {
+		t, err = newTenantRouter(c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("discovery file [%s]: %v", d.file, err)
+	}
+
+	d.mu.Lock()
+	previous := d.settings
+	d.settings = settings
+	d.lastReload = time.Now()
+	d.mu.Unlock()
+	logSettingsDiff(previous, settings)
+	return t, nil
+}
+
+// read returns the keys of the discovery file, only the petasos, talaria
+// and tenants sections may be set there.
+func (d *discovery) read() (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigFile(d.file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("discovery file [%s]: %v", d.file, err)
+	}
+	settings := make(map[string]interface{})
+	for _, key := range v.AllKeys() {
+		if !strings.HasPrefix(key, "petasos.") && !strings.HasPrefix(key, "talaria.") && !strings.HasPrefix(key, "tenants.") {
+			return nil, fmt.Errorf("discovery file [%s]: [%s] can not be discovered, only petasos, talaria and tenants", d.file, key)
+		}
+		settings[key] = v.Get(key)
+	}
+	return settings, nil
+}
+
+// lastReloadTime returns when the discovery file was last applied.
+func (d *discovery) lastReloadTime() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastReload
+}
+
+// logSettingsDiff logs every key which was added, removed or changed,
+// secrets are masked.
+func logSettingsDiff(previous, next map[string]interface{}) {
+	keys := make(map[string]bool, len(previous)+len(next))
+	for key := range previous {
+		keys[key] = true
+	}
+	for key := range next {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		before, existed := previous[key]
+		after, exists := next[key]
+		switch {
+		case !existed:
+			log.Info().Msgf("discovered %s: %v", key, redact(key, after))
+		case !exists:
+			log.Info().Msgf("discovery removed %s: %v", key, redact(key, before))
+		case !reflect.DeepEqual(before, after):
+			log.Info().Msgf("discovery changed %s from %v to %v", key, redact(key, before), redact(key, after))
+		}
+	}
+}
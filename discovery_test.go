@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDiscovery(t *testing.T, content string) (*discovery, *viper.Viper, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "discovery")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "endpoints.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+
+	root := testViper(t, map[string]interface{}{
+		"discovery.file":   file,
+		"petasos.endpoint": "http://petasos:6400",
+		"talaria.internal": "talaria",
+		"talaria.external": "talaria",
+		"talaria.domain":   "example.com",
+	})
+	return newDiscovery(DiscoveryConfig{File: file}), root, file
+}
+
+func petasosEndpoints(t *tenantRouter) []string {
+	var endpoints []string
+	for _, u := range t.petasosURLs() {
+		endpoints = append(endpoints, u.String())
+	}
+	return endpoints
+}
+
+func TestDiscoveryOverlaysEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	d, root, _ := newTestDiscovery(t, "petasos:\n  endpoints: [http://petasos-0:6400, http://petasos-1:6400]\n")
+	router, err := d.tenantRouter(root)
+	require.NoError(t, err)
+	assert.Equal([]string{"http://petasos-0:6400", "http://petasos-1:6400"}, petasosEndpoints(router))
+
+	route, err := router.resolve("")
+	require.NoError(t, err)
+	mapped, err := route.talaria.mapHost("talaria", "")
+	assert.NoError(err)
+	assert.Equal("talaria.example.com", mapped.Host, "sections not discovered are kept")
+}
+
+func TestDiscoveryRejectsOtherSections(t *testing.T) {
+	d, root, _ := newTestDiscovery(t, "server:\n  port: 1\n")
+	_, err := d.tenantRouter(root)
+	assert.Error(t, err)
+}
+
+func TestConfigReloaderAppliesDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	previous := currentConfig()
+	t.Cleanup(func() { applyConfig(previous) })
+	defer func(r *metricRegistry) { registry = r }(registry)
+	registry = registerMetrics(MetricsConfig{})
+
+	d, _, discoveryFile := newTestDiscovery(t, "petasos:\n  endpoints: [http://petasos-0:6400]\n")
+	file := filepath.Join(filepath.Dir(discoveryFile), "petasos-rewriter.yaml")
+	writeTestConfig(t, file, "https")
+	r := newConfigReloader(file, d, nil)
+	require.NoError(t, r.reload(reloadTriggerSignal))
+	require.NoError(t, r.start())
+	defer r.stop()
+	assert.Equal([]string{"http://petasos-0:6400"}, petasosEndpoints(currentConfig().tenants))
+	started := testutil.ToFloat64(registry.DiscoveryLastReload)
+	assert.Equal(float64(d.lastReloadTime().Unix()), started)
+
+	// a changed file is applied live
+	require.NoError(t, ioutil.WriteFile(discoveryFile, []byte("petasos:\n  endpoints: [http://petasos-1:6400]\n"), 0644))
+	assert.Eventually(func() bool {
+		endpoints := petasosEndpoints(currentConfig().tenants)
+		return len(endpoints) == 1 && endpoints[0] == "http://petasos-1:6400"
+	}, time.Second, 10*time.Millisecond)
+	assert.Greater(testutil.ToFloat64(registry.DiscoveryLastReload), started)
+	assert.Zero(testutil.ToFloat64(registry.DiscoveryReloadErrors))
+
+	// an invalid file keeps the endpoints
+	require.NoError(t, ioutil.WriteFile(discoveryFile, []byte("petasos:\n  endpoints: [petasos-2]\n"), 0644))
+	assert.Eventually(func() bool {
+		return testutil.ToFloat64(registry.DiscoveryReloadErrors) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal([]string{"http://petasos-1:6400"}, petasosEndpoints(currentConfig().tenants))
+	status := r.status()
+	assert.Equal(reloadTriggerDiscovery, status.Trigger)
+	assert.False(status.Success)
+}
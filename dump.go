@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// secretKeys are masked wherever the configuration is shown.
+var secretKeys = []string{"sentry.dsn"}
+
+// secretPatterns mask every key whose last segment contains one of them.
+var secretPatterns = []string{"dsn", "token", "password", "secret"}
+
+const redacted = "****"
+
+// Sources of a configuration value, the first one set wins. Values of
+// files are shown as file:<path>.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+// Formats of config dump
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+)
+
+// isSecret tells whether the value of key must not be shown.
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if key == strings.ToLower(secret) {
+			return true
+		}
+	}
+	last := key[strings.LastIndex(key, ".")+1:]
+	for _, pattern := range secretPatterns {
+		if strings.Contains(last, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact masks the value of a secret key and the secret keys of nested
+// maps, unset secrets are kept to show they are unset. Maps are returned
+// with string keys so they can be encoded as JSON.
+func redact(key string, value interface{}) interface{} {
+	if isSecret(key) && value != nil && value != "" {
+		return redacted
+	}
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			child := fmt.Sprint(k)
+			m[child] = redact(key+"."+child, v)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[k] = redact(key+"."+k, v)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(value))
+		for i, v := range value {
+			l[i] = redact(key, v)
+		}
+		return l
+	}
+	return value
+}
+
+// valueSources returns where the value of every key of v comes from.
+func valueSources(v *viper.Viper, flags *pflag.FlagSet) (map[string]string, error) {
+	files, err := fileSources(v)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]string)
+	for _, key := range v.AllKeys() {
+		if flag := lookupFlag(flags, key); flag != nil && flag.Changed {
+			sources[key] = sourceFlag
+		} else if _, ok := lookupEnv(key); ok {
+			sources[key] = sourceEnv
+		} else if file, ok := files[key]; ok {
+			sources[key] = file
+		} else {
+			sources[key] = sourceDefault
+		}
+	}
+	return sources, nil
+}
+
+// dumpedValue is a configuration value as shown by config dump.
+type dumpedValue struct {
+	Value  interface{} `yaml:"value" json:"value"`
+	Source string      `yaml:"source" json:"source"`
+}
+
+// dumpConfig writes the effective configuration of v with secrets masked
+// and the source of each value, nested like the configuration file.
+func dumpConfig(v *viper.Viper, flags *pflag.FlagSet, format string, w io.Writer) error {
+	if format != formatYAML && format != formatJSON {
+		return fmt.Errorf("invalid format [%s], must be one of [%s, %s]", format, formatYAML, formatJSON)
+	}
+	sources, err := valueSources(v, flags)
+	if err != nil {
+		return err
+	}
+
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	settings := make(map[string]interface{})
+	for _, key := range keys {
+		path := strings.Split(key, ".")
+		node := settings
+		for _, segment := range path[:len(path)-1] {
+			child, ok := node[segment].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[segment] = child
+			}
+			node = child
+		}
+		node[path[len(path)-1]] = dumpedValue{Value: redact(key, v.Get(key)), Source: sources[key]}
+	}
+
+	if format == formatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(settings)
+	}
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// lookupFlag returns the flag of key, flag names keep the case of the key.
+func lookupFlag(flags *pflag.FlagSet, key string) *pflag.Flag {
+	if flags == nil {
+		return nil
+	}
+	var found *pflag.Flag
+	flags.VisitAll(func(f *pflag.Flag) {
+		if strings.ToLower(f.Name) == key {
+			found = f
+		}
+	})
+	return found
+}
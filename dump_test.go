@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestIsSecret(t *testing.T) {
+	testData := []struct {
+		key    string
+		secret bool
+	}{
+		{"sentry.dsn", true},
+		{"Sentry.DSN", true},
+		{"remoteUpdate.token", true},
+		{"auth.clientSecret", true},
+		{"db.password", true},
+		{"sentry.environment", false},
+		{"tokens.file.path", false},
+		{"server.port", false},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, record.secret, isSecret(record.key))
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(redacted, redact("sentry.dsn", "https://key@sentry.io/1"))
+	assert.Equal("", redact("sentry.dsn", ""), "unset secrets are shown")
+	assert.Equal("Local", redact("sentry.environment", "Local"))
+
+	nested := redact("upstreams", []interface{}{
+		map[interface{}]interface{}{"url": "http://a", "token": "t0p"},
+	})
+	assert.Equal([]interface{}{map[string]interface{}{"url": "http://a", "token": redacted}}, nested)
+}
+
+func TestDumpConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "petasos-rewriter.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("sentry:\n  dsn: https://key@sentry.io/1\n  environment: Local\n"), 0644))
+
+	os.Setenv("PETASOS_REWRITER_SENTRY_ENVIRONMENT", "prod")
+	defer os.Unsetenv("PETASOS_REWRITER_SENTRY_ENVIRONMENT")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addConfigFlags(flags)
+	require.NoError(t, flags.Parse([]string{"--log.level", "info"}))
+
+	v := viper.New()
+	require.NoError(t, readConfig(v, file, flags))
+
+	var out bytes.Buffer
+	require.NoError(t, dumpConfig(v, flags, formatYAML, &out))
+	var dumped map[string]map[string]dumpedValue
+	require.NoError(t, yaml.Unmarshal(out.Bytes(), &dumped))
+	assert.Equal(t, dumpedValue{Value: redacted, Source: sourceFile + ":" + file}, dumped["sentry"]["dsn"])
+	assert.Equal(t, dumpedValue{Value: "prod", Source: sourceEnv}, dumped["sentry"]["environment"])
+	assert.Equal(t, dumpedValue{Value: 1323, Source: sourceDefault}, dumped["server"]["port"])
+	assert.Equal(t, dumpedValue{Value: "info", Source: sourceFlag}, dumped["log"]["level"])
+
+	out.Reset()
+	require.NoError(t, dumpConfig(v, flags, formatJSON, &out))
+	dumped = nil
+	require.NoError(t, json.Unmarshal(out.Bytes(), &dumped))
+	assert.Equal(t, dumpedValue{Value: redacted, Source: sourceFile + ":" + file}, dumped["sentry"]["dsn"])
+	assert.NotContains(t, out.String(), "key@sentry.io")
+
+	assert.Error(t, dumpConfig(v, flags, "xml", &out))
+}
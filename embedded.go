@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// How the talaria of a device is found
+const (
+	// petasosModeUpstream asks petasos
+	petasosModeUpstream = "upstream"
+	// petasosModeEmbedded assigns talaria without petasos
+	petasosModeEmbedded = "embedded"
+	// petasosModeFallback asks petasos and assigns talaria itself while
+	// petasos can not be asked
+	petasosModeFallback = "fallback"
+)
+
+// ErrNoTalaria is returned when the ring has no talaria instance.
+var ErrNoTalaria = fmt.Errorf("No talaria instance available")
+
+// talariaRing assigns devices to talaria instances the way petasos does:
+// a consistent hash ring over the instances, keyed on the device id. The
+// instances are taken from talaria.instances or, if set, from the
+// talaria.instancesFile which is reloaded whenever it changes.
+type talariaRing struct {
+	file       string
+	vnodeCount int
+	stop       func()
+
+	mu        sync.RWMutex
+	ring      *hashRing
+	instances map[string]*url.URL
+}
+
+// newTalariaRing reads the instances of the `talaria` section, nil is
+// returned if none are configured.
+func newTalariaRing(c TalariaConfig) (*talariaRing, error) {
+	r := &talariaRing{
+		file:       c.InstancesFile,
+		vnodeCount: c.VnodeCount,
+	}
+	if r.vnodeCount <= 0 {
+		r.vnodeCount = defaultVnodeCount
+	}
+
+	if r.file == "" {
+		if len(c.Instances) == 0 {
+			return nil, nil
+		}
+		if err := r.update(c.Instances); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	stop, err := watchFile(r.file, func() {
+		if err := r.load(); err != nil {
+			log.Error().Msgf("keeping talaria instances, reloading [%s] failed: %v", r.file, err)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid talaria.instancesFile: %v", err)
+	}
+	r.stop = stop
+	return r, nil
+}
+
+// load reads the `instances` list of the instances file.
+func (r *talariaRing) load() error {
+	v := viper.New()
+	v.SetConfigFile(r.file)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("invalid talaria.instancesFile: %v", err)
+	}
+	return r.update(v.GetStringSlice("instances"))
+}
+
+// update replaces the instances and rebuilds the ring. An empty list is
+// rejected so that a truncated instances file keeps the ring.
+func (r *talariaRing) update(instances []string) error {
+	if len(instances) == 0 {
+		return fmt.Errorf("invalid talaria.instances: no instances")
+	}
+	parsed := make(map[string]*url.URL, len(instances))
+	for i, instance := range instances {
+		u, err := url.Parse(instance)
+		if err != nil {
+			return fmt.Errorf("invalid talaria.instances[%d]: %v", i, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid talaria.instances[%d] [%s]: scheme and host are required", i, instance)
+		}
+		parsed[u.String()] = u
+	}
+	nodes := make([]string, 0, len(parsed))
+	for node := range parsed {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	r.mu.Lock()
+	r.ring = newHashRing(nodes, r.vnodeCount)
+	r.instances = parsed
+	r.mu.Unlock()
+
+	log.Info().Msgf("talaria instances %v", nodes)
+	return nil
+}
+
+// assign returns the talaria instance of deviceName.
+func (r *talariaRing) assign(deviceName string) (*url.URL, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	node, ok := r.ring.get([]byte(normalizeDeviceID(deviceName)))
+	if !ok {
+		return nil, ErrNoTalaria
+	}
+	return r.instances[node], nil
+}
+
+// close stops watching the instances file.
+func (r *talariaRing) close() {
+	if r != nil && r.stop != nil {
+		r.stop()
+	}
+}
+
+// normalizeDeviceID returns the device id petasos hashes: the prefix is
+// lower cased, a service after the id is dropped, mac addresses lose
+// their separators and are lower cased.
+func normalizeDeviceID(deviceName string) string {
+	i := strings.Index(deviceName, ":")
+	if i < 0 {
+		return deviceName
+	}
+	prefix, value := strings.ToLower(deviceName[:i]), deviceName[i+1:]
+	if j := strings.Index(value, "/"); j >= 0 {
+		value = value[:j]
+	}
+	if prefix == "mac" {
+		value = strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "", ",", "").Replace(value))
+	}
+	return prefix + ":" + value
+}
+
+// assignTalaria redirects the device to its talaria instance on the ring,
+// rewritten just like a petasos redirect.
+func assignTalaria(c echo.Context, cfg *runtimeConfig, route *routing, originalRequestScheme string) (*cachedRedirect, *forwardError) {
+	req := c.Request()
+	instance, err := route.talariaRing.assign(req.Header.Get("X-Webpa-Device-Name"))
+	if err != nil {
+		return nil, newForwardError(errNoTalaria, err)
+	}
+	location := *instance
+	location.Path = strings.TrimRight(instance.Path, "/") + req.URL.Path
+	location.RawQuery = req.URL.RawQuery
+
+	headers := make(http.Header)
+	headers.Set("Location", location.String())
+	return rewriteRedirect(c, cfg, route, http.StatusTemporaryRedirect, headers, nil, originalRequestScheme)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeDeviceID(t *testing.T) {
+	testData := []struct {
+		deviceName string
+		expected   string
+	}{
+		{"mac:112233445566", "mac:112233445566"},
+		{"MAC:11:22:33:AA:BB:CC", "mac:112233aabbcc"},
+		{"mac:11-22-33-aa-bb-cc", "mac:112233aabbcc"},
+		{"UUID:ABC-def", "uuid:ABC-def"},
+		{"serial:ABC123456/config", "serial:ABC123456"},
+		{"noprefix", "noprefix"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, record.expected, normalizeDeviceID(record.deviceName))
+		})
+	}
+}
+
+func TestTalariaRingAssign(t *testing.T) {
+	assert := assert.New(t)
+	r, err := newTalariaRing(TalariaConfig{
+		Instances: []string{"http://talaria-0:6200", "http://talaria-1:6200", "http://talaria-2:6200"},
+	})
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		device := "mac:1122334455" + strconv.Itoa(i)
+		u, err := r.assign(device)
+		assert.NoError(err)
+		seen[u.String()] = true
+	}
+	assert.Len(seen, 3)
+
+	a, _ := r.assign("mac:11:22:33:44:55:66")
+	b, _ := r.assign("mac:112233445566")
+	assert.Equal(a, b, "device ids are normalized before hashing")
+
+	assert.Error(r.update(nil))
+	c, err := r.assign("mac:112233445566")
+	assert.NoError(err)
+	assert.Equal(b, c, "an empty list keeps the ring")
+}
+
+func TestTalariaRingAssignsLikePetasos(t *testing.T) {
+	// assignments of the consistent hash accessor of petasos, with the
+	// default vnode count, for the device ids parsed by petasos
+	r, err := newTalariaRing(TalariaConfig{
+		Instances: []string{"http://talaria-0:6200", "http://talaria-1:6200", "http://talaria-2:6200", "http://talaria-3:6200"},
+	})
+	require.NoError(t, err)
+
+	testData := []struct {
+		deviceName string
+		expected   string
+	}{
+		{"mac:112233445566", "http://talaria-2:6200"},
+		{"MAC:11:22:33:44:55:66", "http://talaria-2:6200"},
+		{"mac:aabbccddeeff", "http://talaria-1:6200"},
+		{"mac:AA-BB-CC-DD-EE-01", "http://talaria-1:6200"},
+		{"mac:0123456789ab", "http://talaria-1:6200"},
+		{"mac:fedcba987654", "http://talaria-0:6200"},
+		{"mac:000000000001", "http://talaria-2:6200"},
+		{"mac:a1b2c3d4e5f6", "http://talaria-3:6200"},
+		{"uuid:3f2504e0-4f89-11d3-9a0c-0305e82c3301", "http://talaria-2:6200"},
+		{"serial:ABC123456", "http://talaria-0:6200"},
+		{"dns:device.example.com", "http://talaria-2:6200"},
+		{"serial:ABC123456/config", "http://talaria-0:6200"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			u, err := r.assign(record.deviceName)
+			assert.NoError(t, err)
+			assert.Equal(t, record.expected, u.String())
+		})
+	}
+}
+
+func TestTalariaRingReloadsInstancesFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "talaria")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "instances.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte("instances:\n  - http://talaria-0:6200\n"), 0644))
+
+	r, err := newTalariaRing(TalariaConfig{InstancesFile: file})
+	require.NoError(t, err)
+	defer r.close()
+
+	u, err := r.assign("mac:112233445566")
+	assert.NoError(err)
+	assert.Equal("http://talaria-0:6200", u.String())
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("instances:\n  - http://talaria-1:6200\n"), 0644))
+	assert.Eventually(func() bool {
+		u, err := r.assign("mac:112233445566")
+		return err == nil && u.String() == "http://talaria-1:6200"
+	}, time.Second, 10*time.Millisecond)
+
+	// invalid and empty files keep the instances
+	for _, content := range []string{"instances:\n  - talaria-2\n", ""} {
+		require.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+		time.Sleep(2 * watchDebounce)
+		u, err = r.assign("mac:112233445566")
+		assert.NoError(err)
+		assert.Equal("http://talaria-1:6200", u.String())
+	}
+}
+
+func TestNewRoutingPetasosMode(t *testing.T) {
+	testData := []struct {
+		settings map[string]interface{}
+		err      bool
+	}{
+		{map[string]interface{}{"petasos.mode": petasosModeEmbedded, "talaria.instances": []string{"http://talaria:6200"}}, false},
+		{map[string]interface{}{"petasos.mode": petasosModeEmbedded}, true},
+		{map[string]interface{}{"petasos.mode": petasosModeFallback, "petasos.endpoint": "http://petasos:6400"}, true},
+		{map[string]interface{}{"petasos.mode": "random", "petasos.endpoint": "http://petasos:6400"}, true},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v := testViper(t, record.settings)
+			v.Set("talaria.internal", "talaria")
+			r, err := newRouting(defaultTenant, loadTestConfig(t, v).RoutingConfig)
+			if record.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Nil(t, r.petasos)
+		})
+	}
+}
+
+// routeWithoutPetasos routes requests without tenant to the talaria
+// ring in the given mode.
+func routeWithoutPetasos(t *testing.T, mode string) {
+	t.Helper()
+	route := currentConfig().tenants.defaultRouting
+	var err error
+	route.talariaRing, err = newTalariaRing(TalariaConfig{Instances: []string{"http://xmidt-talaria:6200"}})
+	require.NoError(t, err)
+	route.mode = mode
+}
+
+func TestForwarderEmbeddedMode(t *testing.T) {
+	assert := assert.New(t)
+	routeToPetasos(t, "http://127.0.0.1:1")
+	routeWithoutPetasos(t, petasosModeEmbedded)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/device?x=1", nil)
+	r.Header.Set("X-Webpa-Device-Name", "mac:112233445566")
+	r.Header.Set("X-Forwarded-Proto", "wss")
+	w := httptest.NewRecorder()
+	assert.Nil(forwarder(echo.New().NewContext(r, w), &http.Client{}))
+	assert.Equal(http.StatusTemporaryRedirect, w.Code)
+	assert.Equal("https://xmidt-talaria.dev.rdk.yo-digital.com/api/v2/device?x=1", w.Header().Get("Location"))
+}
+
+func TestForwarderFallbackMode(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	server.Close()
+	routeToPetasos(t, server.URL)
+	routeWithoutPetasos(t, petasosModeFallback)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+	r.Header.Set("X-Webpa-Device-Name", "mac:112233445566")
+	r.Header.Set("X-Forwarded-Proto", "wss")
+	w := httptest.NewRecorder()
+	assert.Nil(forwarder(echo.New().NewContext(r, w), &http.Client{}))
+	assert.Equal(http.StatusTemporaryRedirect, w.Code)
+	assert.Equal("https://xmidt-talaria.dev.rdk.yo-digital.com/api/v2/device", w.Header().Get("Location"))
+
+	// without fallback petasos failures are errors
+	currentConfig().tenants.defaultRouting.mode = petasosModeUpstream
+	w = httptest.NewRecorder()
+	assert.Nil(forwarder(echo.New().NewContext(r, w), &http.Client{}))
+	assert.Equal(http.StatusBadGateway, w.Code)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const problemContentType = "application/problem+json"
+
+// errorKind classifies why a request could not be forwarded.
+type errorKind string
+
+const (
+	// petasos could not be connected to or dropped the connection
+	errPetasosUnreachable errorKind = "petasos_unreachable"
+	// petasos did not answer in time
+	errPetasosTimeout errorKind = "petasos_timeout"
+	// petasos answered with a body we can not handle
+	errInvalidResponse errorKind = "invalid_response"
+	// petasos answered with a Location which can not be parsed or mapped
+	errInvalidLocation errorKind = "invalid_location"
+	// the device went away before the response was written
+	errClientDisconnected errorKind = "client_disconnected"
+	// the X-TENANT-ID is not configured and unknown tenants are rejected
+	errUnknownTenant errorKind = "unknown_tenant"
+	// the petasos circuit breaker is open, petasos is not called
+	errCircuitOpen errorKind = "circuit_open"
+	// no talaria instance is known to assign the device to
+	errNoTalaria errorKind = "no_talaria"
+)
+
+// errorKinds lists every kind, each one gets its own counter.
+var errorKinds = []errorKind{
+	errPetasosUnreachable,
+	errPetasosTimeout,
+	errInvalidResponse,
+	errInvalidLocation,
+	errClientDisconnected,
+	errUnknownTenant,
+	errCircuitOpen,
+	errNoTalaria,
+}
+
+var errorTitles = map[errorKind]string{
+	errPetasosUnreachable: "petasos is unreachable",
+	errPetasosTimeout:     "petasos did not respond in time",
+	errInvalidResponse:    "petasos sent an invalid response",
+	errInvalidLocation:    "petasos sent an invalid location",
+	errClientDisconnected: "client disconnected",
+	errUnknownTenant:      "unknown tenant",
+	errCircuitOpen:        "petasos is temporarily unavailable",
+	errNoTalaria:          "no talaria instance is available",
+}
+
+// forwardError is returned by the forwarding path, it carries the kind
+// used to pick the status code, the metric and the sentry tag.
+type forwardError struct {
+	Kind errorKind
+	Err  error
+	// RetryAfter is sent as Retry-After header when set
+	RetryAfter time.Duration
+}
+
+func (e *forwardError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *forwardError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the status code sent to the device for this error.
+func (e *forwardError) StatusCode() int {
+	switch e.Kind {
+	case errPetasosTimeout:
+		return http.StatusGatewayTimeout
+	case errClientDisconnected:
+		// nobody is listening anymore, only used for logging
+		return 499
+	case errUnknownTenant:
+		return http.StatusForbidden
+	case errCircuitOpen, errNoTalaria:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// reported tells whether the error is sent to sentry. Disconnected
+// devices and unknown tenants are caused by the clients, they are only
+// counted.
+func (e *forwardError) reported() bool {
+	return e.Kind != errClientDisconnected && e.Kind != errUnknownTenant
+}
+
+// problem is the RFC 7807 problem details body. The underlying error is
+// only logged, it may contain internal addresses.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func newForwardError(kind errorKind, err error) *forwardError {
+	return &forwardError{Kind: kind, Err: err}
+}
+
+// classifyUpstreamError maps an error returned by client.Do to its kind.
+func classifyUpstreamError(ctx context.Context, err error) *forwardError {
+	if ctx.Err() == context.Canceled {
+		return newForwardError(errClientDisconnected, err)
+	}
+	// http.Client parses the Location of redirects itself, before
+	// CheckRedirect is called, and only reports a plain error.
+	if strings.Contains(err.Error(), "failed to parse Location header") {
+		return newForwardError(errInvalidLocation, err)
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return newForwardError(errPetasosTimeout, err)
+	}
+	return newForwardError(errPetasosUnreachable, err)
+}
+
+// handleForwardError counts, logs and, unless caused by the client,
+// reports err and, as long as nothing has been written yet, answers with
+// a problem+json body.
+func handleForwardError(c echo.Context, err *forwardError) error {
+	req := c.Request()
+	log.Ctx(req.Context()).Error().Str("kind", string(err.Kind)).Msg(err.Error())
+
+	if registry != nil {
+		registry.ForwardErrors[err.Kind].Inc()
+	}
+
+	if err.reported() {
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("error_kind", string(err.Kind))
+			sentry.CaptureException(err)
+		})
+	}
+
+	if err.Kind == errClientDisconnected || c.Response().Committed {
+		return nil
+	}
+
+	c.Response().Header().Del("Location")
+	c.Response().Header().Del("Content-Length")
+	c.Response().Header().Set(echo.HeaderContentType, problemContentType)
+	if err.RetryAfter > 0 {
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	}
+	return c.JSON(err.StatusCode(), problem{
+		Type:     "urn:petasos-rewriter:error:" + string(err.Kind),
+		Title:    errorTitles[err.Kind],
+		Status:   err.StatusCode(),
+		Instance: req.URL.Path,
+	})
+}
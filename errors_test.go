@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwarderErrors(t *testing.T) {
+	testData := []struct {
+		description string
+		handler     http.HandlerFunc
+		closed      bool
+		timeout     time.Duration
+		status      int
+		kind        errorKind
+	}{
+		{
+			description: "petasos is down",
+			closed:      true,
+			status:      http.StatusBadGateway,
+			kind:        errPetasosUnreachable,
+		},
+		{
+			description: "petasos is too slow",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			timeout: 50 * time.Millisecond,
+			status:  http.StatusGatewayTimeout,
+			kind:    errPetasosTimeout,
+		},
+		{
+			description: "petasos sends a broken location",
+			handler: func(response http.ResponseWriter, request *http.Request) {
+				response.Header().Set("Location", "http://talaria%zz:6200/api/v2/device")
+				response.WriteHeader(http.StatusTemporaryRedirect)
+			},
+			status: http.StatusBadGateway,
+			kind:   errInvalidLocation,
+		},
+	}
+
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+
+			server := httptest.NewServer(record.handler)
+			routeToPetasos(t, server.URL)
+			if record.closed {
+				server.Close()
+			} else {
+				defer server.Close()
+			}
+
+			r := httptest.NewRequest("", "/v2/api/device", nil)
+			w := httptest.NewRecorder()
+			client := &http.Client{
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+				Timeout: record.timeout,
+			}
+			err := forwarder(echo.New().NewContext(r, w), client)
+			assert.Nil(err, record.description)
+			assert.Equal(record.status, w.Code, record.description)
+			assert.Equal(problemContentType, w.Header().Get("Content-Type"))
+			assert.Empty(w.Header().Get("Location"))
+
+			var body problem
+			assert.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(record.status, body.Status)
+			assert.Equal("urn:petasos-rewriter:error:"+string(record.kind), body.Type)
+		})
+	}
+}
+
+func TestHandleForwardErrorReports(t *testing.T) {
+	var reported []string
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		BeforeSend: func(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+			reported = append(reported, event.Tags["error_kind"])
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	hub := sentry.CurrentHub()
+	previous := hub.Client()
+	hub.BindClient(client)
+	defer hub.BindClient(previous)
+
+	defer func(r *metricRegistry) { registry = r }(registry)
+	registry = registerMetrics(MetricsConfig{})
+
+	for _, kind := range []errorKind{errPetasosUnreachable, errClientDisconnected, errUnknownTenant} {
+		c := echo.New().NewContext(httptest.NewRequest("", "/api/v2/device", nil), httptest.NewRecorder())
+		assert.NoError(t, handleForwardError(c, newForwardError(kind, errors.New("failed"))))
+		assert.Equal(t, float64(1), testutil.ToFloat64(registry.ForwardErrors[kind]), kind)
+	}
+	assert.Equal(t, []string{string(errPetasosUnreachable)}, reported, "errors caused by clients are only counted")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// envPrefix is the environment variable prefix without the hyphen of the
+// application name, which many shells and orchestrators can not handle.
+const envPrefix = "PETASOS_REWRITER"
+
+// configFlag is a configuration key exposed as command line flag, value
+// is the zero value of its type.
+type configFlag struct {
+	key   string
+	value interface{}
+	usage string
+}
+
+// configFlags are the configuration keys which can be set on the command
+// line. Maps like tenants, talaria.rules and talaria.port.map can only be
+// set in the configuration file.
+var configFlags = append([]configFlag{
+	{"server.port", 0, "port on which the application is running"},
+	{"server.fixedScheme", "", "scheme of all redirects [http, https], the one of the request if empty"},
+	{"server.authHeader.check.enabled", false, "reject requests without Authorization header"},
+	{"server.authHeader.check.mode", "", "what failed checks do [enforce, audit]"},
+	{"server.authHeader.check.requestPath", "", "path below which the Authorization header is checked, ignored if server.authHeader.policies are set"},
+	{"server.authHeader.jwt.jwksFile", "", "JWKS file bearer tokens are verified with, reloaded on change"},
+	{"server.authHeader.jwt.issuer", "", "required iss of bearer tokens"},
+	{"server.authHeader.jwt.audience", []string{}, "accepted aud of bearer tokens"},
+	{"server.authHeader.jwt.clockSkew", time.Duration(0), "clock skew tolerated checking exp and nbf"},
+	{"authorization.capabilitiesClaim", "", "claim holding the capabilities of tokens, capabilities if empty"},
+	{"certificatePolicy.issuer.mode", "", "device certificate issuer allowlist [off, enforce, audit]"},
+	{"certificatePolicy.issuer.allowed", []string{}, "allowed X-Issuer-CN of device certificates"},
+	{"certificatePolicy.expiry.mode", "", "device certificate expiry check [off, enforce, audit]"},
+	{"certificatePolicy.expiry.days", 0, "days device certificates must at least be valid"},
+	{"certificatePolicy.deviceCN.mode", "", "X-DEVICE-CN must match the mac of the device name [off, enforce, audit]"},
+	{"petasos.mode", "", "how talaria is found [upstream, embedded, fallback]"},
+	{"petasos.endpoint", "", "petasos endpoint"},
+	{"petasos.endpoints", []string{}, "petasos endpoints, wins over petasos.endpoint"},
+	{"petasos.balancer.strategy", "", "petasos balancing [roundRobin, leastOutstanding, consistentHash]"},
+	{"petasos.ejection.consecutiveFailures", 0, "failures in a row ejecting a petasos backend"},
+	{"petasos.ejection.duration", time.Duration(0), "how long an ejected petasos backend is not used"},
+	{"redirect.statusCodes", []int{}, "status codes of petasos responses which are rewritten"},
+	{"redirect.normalizeStatusCode", 0, "status code rewritten redirects are sent with"},
+	{"talaria.internal", "", "talaria host replaced with talaria.external"},
+	{"talaria.external", "", "replacement of talaria.internal"},
+	{"talaria.domain", "", "public talaria domain"},
+	{"talaria.instances", []string{}, "talaria instances of the embedded and fallback petasos modes"},
+	{"talaria.instancesFile", "", "file with the talaria instances, reloaded on change"},
+	{"talaria.vnodeCount", 0, "points per talaria instance on the hash ring"},
+	{"talaria.port.policy", "", "port of the Location petasos sent [keep, drop, map]"},
+	{"talaria.unmatched.policy", "", "hosts no rule matches [error, passthrough, default]"},
+	{"talaria.unmatched.default.host", "", "host of the unmatched default"},
+	{"talaria.unmatched.default.domain", "", "domain of the unmatched default"},
+	{"talaria.unmatched.default.port", 0, "port of the unmatched default"},
+	{"talaria.unmatched.default.scheme", "", "scheme of the unmatched default"},
+	{"upstream.client.dialTimeout", time.Duration(0), "timeout to establish a TCP connection"},
+	{"upstream.client.keepAlive", time.Duration(0), "TCP keep-alive period"},
+	{"upstream.client.tlsHandshakeTimeout", time.Duration(0), "timeout of the TLS handshake"},
+	{"upstream.client.responseHeaderTimeout", time.Duration(0), "timeout for the response headers"},
+	{"upstream.client.requestTimeout", time.Duration(0), "overall timeout of an upstream request"},
+	{"upstream.client.maxIdleConns", 0, "idle connections kept open in total"},
+	{"upstream.client.maxIdleConnsPerHost", 0, "idle connections kept open per upstream host"},
+	{"upstream.client.idleConnTimeout", time.Duration(0), "how long an idle connection is kept open"},
+	{"discovery.file", "", "endpoints file overlaying the petasos, talaria and tenants sections"},
+	{"cache.enabled", false, "cache rewritten redirects"},
+	{"cache.ttl", time.Duration(0), "how long cached redirects are served"},
+	{"cache.maxSize", 0, "cached redirects kept at most"},
+	{"cache.maxStale", time.Duration(0), "how long expired redirects are served while petasos is down"},
+	{"tenancy.unknownTenant", "", "requests of unknown tenants [reject, default]"},
+	{"sentry.dsn", "", "sentry DSN, NA disables sentry"},
+	{"sentry.environment", "", "sentry environment"},
+	{"sentry.debug", false, "sentry debug mode"},
+	{"log.type", "", "log output [stdout, file]"},
+	{"log.json", false, "log JSON to stdout"},
+	{"log.level", "", "log level [debug, info, error]"},
+	{"log.dir", "", "directory of the log file"},
+	{"log.fileName", "", "name of the log file"},
+	{"log.maxSize", 0, "size in MB the log file is rotated at"},
+	{"log.maxAge", 0, "hours rotated log files are kept"},
+	{"log.maxBackups", 0, "rotated log files kept"},
+	{"traceProvider.type", "", "trace provider [stdout, jaeger, zipkin, noop]"},
+	{"traceProvider.endpoint", "", "endpoint of the jaeger or zipkin collector"},
+	{"traceProvider.skipTraceExport", false, "skip exporting traces to stdout"},
+	{"remoteUpdate.enable", false, "update the IP address of resources"},
+	{"remoteUpdate.url", "", "resource update endpoint, the device is appended"},
+	{"metricsOptions.port", 0, "port on which the metrics are served"},
+	{"metricsOptions.namespace", "", "namespace of the metrics"},
+	{"metricsOptions.subsystem", "", "subsystem of the metrics"},
+	{"metricsOptions.adminReload", false, "serve the unauthenticated configuration reload API on the metrics port"},
+}, circuitBreakerFlags(upstreamPetasos, upstreamResourceUpdate)...)
+
+func circuitBreakerFlags(upstreams ...string) []configFlag {
+	var flags []configFlag
+	for _, upstream := range upstreams {
+		prefix := "circuitBreaker." + upstream + "."
+		flags = append(flags,
+			configFlag{prefix + "enabled", false, "circuit breaker of " + upstream},
+			configFlag{prefix + "failureRateThreshold", float64(0), "failure rate opening the breaker"},
+			configFlag{prefix + "slowCallThreshold", time.Duration(0), "calls slower than this count as failures"},
+			configFlag{prefix + "minRequests", 0, "calls in a window before the breaker can open"},
+			configFlag{prefix + "window", time.Duration(0), "window the failure rate is calculated over"},
+			configFlag{prefix + "coolDown", time.Duration(0), "how long the breaker stays open"},
+			configFlag{prefix + "halfOpenProbes", 0, "calls deciding whether the breaker closes again"},
+		)
+	}
+	return flags
+}
+
+// addConfigFlags defines a flag for every entry of configFlags.
+func addConfigFlags(flags *pflag.FlagSet) {
+	for _, f := range configFlags {
+		switch value := f.value.(type) {
+		case string:
+			flags.String(f.key, value, f.usage)
+		case int:
+			flags.Int(f.key, value, f.usage)
+		case bool:
+			flags.Bool(f.key, value, f.usage)
+		case float64:
+			flags.Float64(f.key, value, f.usage)
+		case time.Duration:
+			flags.Duration(f.key, value, f.usage)
+		case []string:
+			flags.StringSlice(f.key, value, f.usage)
+		case []int:
+			flags.IntSlice(f.key, value, f.usage)
+		default:
+			panic(fmt.Sprintf("flag [%s] has unsupported type %T", f.key, f.value))
+		}
+	}
+}
+
+// envNames returns the environment variables of key, the one with the
+// PETASOS_REWRITER_ prefix first.
+func envNames(key string) []string {
+	name := strings.ToUpper(strings.Replace(key, ".", "_", -1))
+	return []string{envPrefix + "_" + name, strings.ToUpper(applicationName) + "_" + name}
+}
+
+// lookupEnv returns the value of the first environment variable of key
+// which is set and not empty.
+func lookupEnv(key string) (string, bool) {
+	for _, name := range envNames(key) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// resolveConfig stores the effective value of every key in v as override:
+// flags set on the command line win over environment variables, which
+// win over the file and the defaults. viper only applies flags and the
+// environment to single keys, resolved sections taken with Sub see them
+// too. Flags which are not set neither hide the file nor count as set.
+func resolveConfig(v *viper.Viper, flags *pflag.FlagSet) {
+	keys := v.AllKeys()
+	for _, f := range configFlags {
+		keys = append(keys, strings.ToLower(f.key))
+	}
+	for _, key := range keys {
+		if value, ok := lookupEnv(key); ok {
+			v.Set(key, value)
+		} else if value := v.Get(key); value != nil {
+			v.Set(key, value)
+		}
+	}
+	if flags == nil {
+		return
+	}
+	// Changed instead of Visit, the persistent flags are parsed as part of
+	// the flags of the command which was run
+	flags.VisitAll(func(f *pflag.Flag) {
+		if !f.Changed {
+			return
+		}
+		switch f.Value.Type() {
+		case "stringSlice":
+			value, _ := flags.GetStringSlice(f.Name)
+			v.Set(f.Name, value)
+		case "intSlice":
+			value, _ := flags.GetIntSlice(f.Name)
+			v.Set(f.Name, value)
+		case "int":
+			value, _ := flags.GetInt(f.Name)
+			v.Set(f.Name, value)
+		case "bool":
+			value, _ := flags.GetBool(f.Name)
+			v.Set(f.Name, value)
+		case "float64":
+			value, _ := flags.GetFloat64(f.Name)
+			v.Set(f.Name, value)
+		default:
+			v.Set(f.Name, f.Value.String())
+		}
+	})
+}
+
+// readConfig reads the configuration file into v, the one found in the
+// config paths if file is empty, merges its conf.d fragments and resolves
+// it with flags.
+func readConfig(v *viper.Viper, file string, flags *pflag.FlagSet) error {
+	configureViper(v, applicationName)
+	if file != "" {
+		v.SetConfigFile(file)
+	}
+	err := v.ReadInConfig()
+	if err == nil {
+		err = mergeFragments(v)
+	}
+	setConfigDefaults(v)
+	resolveConfig(v, flags)
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	t.Helper()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addConfigFlags(flags)
+	require.NoError(t, flags.Parse(args))
+	return flags
+}
+
+func setTestEnv(t *testing.T, name, value string) {
+	t.Helper()
+	require.NoError(t, os.Setenv(name, value))
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func TestReadConfigPrecedence(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "flags")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "petasos-rewriter.yaml")
+	content := "server:\n  port: 2000\n  fixedScheme: http\ncache:\n  ttl: 1m\n  maxSize: 10\nlog:\n  level: error\n"
+	require.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+
+	setTestEnv(t, "PETASOS_REWRITER_SERVER_PORT", "3000")
+	setTestEnv(t, "PETASOS_REWRITER_CACHE_TTL", "2m")
+	setTestEnv(t, "PETASOS-REWRITER_LOG_LEVEL", "info")
+	flags := newTestFlags(t, "--server.port", "4000", "--redirect.statusCodes", "301,307")
+
+	v := viper.New()
+	require.NoError(t, readConfig(v, file, flags))
+	assert.Equal(4000, v.GetInt("server.port"), "flags win over the environment")
+	assert.Equal("http", v.GetString("server.fixedScheme"), "the file wins over defaults")
+	assert.Equal("info", v.GetString("log.level"), "the hyphen prefix is still applied")
+	assert.Equal(1324, v.GetInt("metricsOptions.port"), "defaults are applied")
+
+	cache := v.Sub("cache")
+	assert.Equal("2m", cache.GetString("ttl"), "sections see the environment")
+	assert.Equal(10, cache.GetInt("maxSize"))
+
+	policy, err := newRedirectPolicy(loadTestConfig(t, v).Redirect)
+	require.NoError(t, err)
+	assert.True(policy.isRewritten(307))
+	assert.False(policy.isRewritten(302), "sections see flags")
+
+	assert.Equal(defaultMinRequests, v.GetInt("circuitBreaker.petasos.minRequests"), "flags not given keep the defaults")
+}
+
+func TestEnvPrefixes(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{"PETASOS_REWRITER_CACHE_MAXSIZE", "PETASOS-REWRITER_CACHE_MAXSIZE"}, envNames("cache.maxSize"))
+
+	setTestEnv(t, "PETASOS-REWRITER_CACHE_MAXSIZE", "1")
+	value, ok := lookupEnv("cache.maxSize")
+	assert.True(ok)
+	assert.Equal("1", value)
+
+	setTestEnv(t, "PETASOS_REWRITER_CACHE_MAXSIZE", "2")
+	value, _ = lookupEnv("cache.maxSize")
+	assert.Equal("2", value, "PETASOS_REWRITER_ wins")
+}
@@ -8,13 +8,13 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,10 +26,30 @@ const (
 	webpaConveyHeader         = "X-WebPA-Convey"
 )
 
+// unknownFirmware is the firmware label of devices without valid
+// X-WebPA-Convey header.
+const unknownFirmware = "unknown"
+
+const (
+	// copyBufferSize is the size of the buffers used to stream
+	// petasos response bodies to the client.
+	copyBufferSize = 32 * 1024
+	// maxRedirectBodySize bounds the redirect body buffered for rewriting.
+	maxRedirectBodySize = 64 * 1024
+)
+
 var (
-	ErrNoMatchFound = fmt.Errorf("No match found")
+	ErrNoMatchFound         = fmt.Errorf("No match found")
+	ErrRedirectBodyTooLarge = fmt.Errorf("Redirect body exceeds %d bytes", maxRedirectBodySize)
 )
 
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
 // forwarder forwards requests to real petasos instance and does
 // appropriate replacements.
 func forwarder(c echo.Context, client *http.Client) error {
@@ -39,10 +59,11 @@ func forwarder(c echo.Context, client *http.Client) error {
 
 	req := c.Request()
 	ctx := req.Context()
+	cfg := currentConfig()
 
-	if isAuthHeaderCheckEnabled && len(c.Request().Header.Get("Authorization")) == 0 {
-		log.Ctx(ctx).Error().Msg("authorization header not provided")
-		return c.JSON(http.StatusBadRequest, echo.NewHTTPError(http.StatusBadRequest, "authorization header not provided"))
+	route, err := cfg.tenants.resolve(req.Header.Get(tenantHeader))
+	if err != nil {
+		return handleForwardError(c, newForwardError(errUnknownTenant, fmt.Errorf("%w: [%s]", err, req.Header.Get(tenantHeader))))
 	}
 
 	// store scheme of original request
@@ -66,66 +87,133 @@ func forwarder(c echo.Context, client *http.Client) error {
 		originalRequestScheme = "https"
 	}
 
-	dump, err := httputil.DumpRequest(req, true)
+	// Request bodies are forwarded as they are, only headers are dumped.
+	dump, err := httputil.DumpRequest(req, false)
 	if err != nil {
-		panic(err)
-		return err
+		return handleForwardError(c, newForwardError(errClientDisconnected, err))
 	}
 	log.Ctx(ctx).Debug().Msg("Dumping original request to petasos-rewriter")
 	log.Ctx(ctx).Debug().Msgf("%s", dump)
 	log.Ctx(ctx).Debug().Msg("") // br
 	log.Ctx(ctx).Debug().Msg("") // br
 
-	if remoteUpdateAddressEnabled {
-		log.Ctx(ctx).Info().Msg("updating resource's IP address and certificate information")
-		err := updateResourceDetails(req, client, resourceURL)
-		if err != nil {
-			log.Ctx(ctx).Error().Msg(err.Error())
+	if route.remoteUpdateEnabled {
+		updateResource(route, req, client)
+	}
+
+	key := cacheKey(cfg, route, req, originalRequestScheme)
+	if cached, ok := deviceCache.fresh(key, route.tenant); ok {
+		log.Ctx(ctx).Debug().Msgf("serving cached redirect for device name [%s]", req.Header.Get("X-Webpa-Device-Name"))
+		return writeCachedRedirect(c, cached)
+	}
+
+	if route.mode == petasosModeEmbedded {
+		redirect, ferr := assignTalaria(c, cfg, route, originalRequestScheme)
+		if ferr != nil {
+			return handleForwardError(c, ferr)
 		}
+		return writeCachedRedirect(c, redirect)
 	}
 
-	// Prepare forwarding to petasos
-	req.URL = &url.URL{
-		Scheme: petasosURL.Scheme,
-		Host:   petasosURL.Host,
-		Path:   req.URL.Path,
+	// the body of other answers is streamed once the lookup returned, so
+	// that waiting requests are let go as soon as the status is known
+	var stream func() *forwardError
+	redirect, ferr := lookups.do(key, route.tenant, func() (redirect *cachedRedirect, ferr *forwardError) {
+		redirect, stream, ferr = askPetasos(c, cfg, route, client, key, originalRequestScheme)
+		return redirect, ferr
+	})
+	if stream != nil {
+		if ferr := stream(); ferr != nil {
+			return handleForwardError(c, ferr)
+		}
+		return nil
 	}
+	if ferr != nil {
+		switch ferr.Kind {
+		case errPetasosUnreachable, errPetasosTimeout, errCircuitOpen:
+			if served, err := serveStale(c, route, key, ferr); served {
+				return err
+			}
+			if route.mode == petasosModeFallback {
+				log.Ctx(ctx).Warn().Msgf("assigning talaria without petasos: %v", ferr)
+				redirect, ferr = assignTalaria(c, cfg, route, originalRequestScheme)
+			}
+		}
+	}
+	if ferr != nil {
+		return handleForwardError(c, ferr)
+	}
+	if redirect != nil {
+		return writeCachedRedirect(c, redirect)
+	}
+	return nil
+}
+
+// askPetasos forwards the request to petasos. Rewritten redirects are
+// returned, and cached, for the caller to send. For any other response
+// the headers are copied and a stream is returned which sends the status
+// code and pipes the body to the client.
+func askPetasos(c echo.Context, cfg *runtimeConfig, route *routing, client *http.Client, key, originalRequestScheme string) (redirect *cachedRedirect, stream func() *forwardError, ferr *forwardError) {
+	req := c.Request()
+	ctx := req.Context()
+
+	// Prepare forwarding to petasos, keeping path, query and fragment
+	forwardURL := *req.URL
+	petasos := route.petasos.pick(req.Header.Get("X-Webpa-Device-Name"))
+	release := route.petasos.acquire(petasos)
+	defer func() {
+		if stream == nil {
+			release()
+		}
+	}()
+	forwardURL.Scheme = petasos.url.Scheme
+	forwardURL.Host = petasos.url.Host
+	forwardURL.User = nil
+	req.URL = &forwardURL
 	req.RequestURI = ""
-	dump, err = httputil.DumpRequest(req, true)
+	dump, err := httputil.DumpRequest(req, false)
 	if err != nil {
-		panic(err)
-		return err
+		return nil, nil, newForwardError(errClientDisconnected, err)
 	}
 	log.Ctx(ctx).Debug().Msg("Dumping request to real petasos")
 	log.Ctx(ctx).Debug().Msgf("%s", dump)
 	log.Ctx(ctx).Debug().Msg("") // br
 	log.Ctx(ctx).Debug().Msg("") // br
+	breakerDone, retryAfter, err := route.petasosBreaker.allow()
+	if err != nil {
+		return nil, nil, &forwardError{Kind: errCircuitOpen, Err: err, RetryAfter: retryAfter}
+	}
+	startTime := time.Now()
 	resp, err := client.Do(req)
+	latency := time.Since(startTime)
 	if err != nil {
-		sentry.CaptureException(err)
-		panic(err)
-		return err
+		ferr := classifyUpstreamError(ctx, err)
+		route.petasos.observe(petasos, latency, ferr.Kind != errClientDisconnected)
+		breakerDone(ferr.Kind != errClientDisconnected, latency)
+		return nil, nil, ferr
 	}
+	route.petasos.observe(petasos, latency, false)
+	breakerDone(resp.StatusCode >= http.StatusInternalServerError, latency)
 
-	dump, err = httputil.DumpResponse(resp, true)
+	defer func() {
+		if stream == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	// Only the headers are dumped, the body is streamed below and
+	// must not be buffered for logging.
+	dump, err = httputil.DumpResponse(resp, false)
 	if err != nil {
-		sentry.CaptureException(err)
-		panic(err)
-		return err
+		return nil, nil, newForwardError(errInvalidResponse, err)
 	}
-	log.Ctx(ctx).Debug().Msg("Dumping response from real petasos")
+	log.Ctx(ctx).Debug().Msg("Dumping response headers from real petasos")
 	log.Ctx(ctx).Debug().Msgf("%s", dump)
 	log.Ctx(ctx).Debug().Msg("") // br
 	log.Ctx(ctx).Debug().Msg("") // br
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		sentry.CaptureException(err)
-		panic(err)
-		return err
-	}
-
 	// just printing the all response headers which we got from actual petasos
+	headers := make(http.Header)
 	for k, v := range resp.Header {
 		if k == "Traceparent" || k == "Tracestate" {
 			continue
@@ -139,79 +227,139 @@ func forwarder(c echo.Context, client *http.Client) error {
 		}
 		header = strings.TrimRight(header, ",")
 		log.Ctx(ctx).Debug().Msgf("k: %s, v: %s\n", k, v)
-		c.Response().Header().Set(k, header)
+		headers.Set(k, header)
 	}
 
-	if resp.StatusCode != http.StatusTemporaryRedirect {
-		// Forward status code
-		c.Response().Writer.WriteHeader(resp.StatusCode)
-		c.Response().Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
-		c.Response().Writer.Write(body)
-		return nil
+	if !cfg.redirects.isRewritten(resp.StatusCode) {
+		// Forward status code and stream the body through
+		for k, v := range headers {
+			c.Response().Header()[k] = v
+		}
+		return nil, func() *forwardError {
+			defer release()
+			defer resp.Body.Close()
+			return streamResponse(c, resp)
+		}, nil
+	}
+
+	// Redirect bodies are tiny, they are the only ones buffered
+	// because the location inside has to be rewritten.
+	body, err := readRedirectBody(resp.Body)
+	if err == ErrRedirectBodyTooLarge {
+		return nil, nil, newForwardError(errInvalidResponse, err)
+	} else if err != nil {
+		return nil, nil, classifyUpstreamError(ctx, err)
 	}
+
+	redirect, ferr = rewriteRedirect(c, cfg, route, resp.StatusCode, headers, body, originalRequestScheme)
+	if ferr != nil {
+		return nil, nil, ferr
+	}
+	deviceCache.put(key, route.tenant, redirect)
+	return redirect, nil, nil
+}
+
+// rewriteRedirect points the Location of a redirect and its body to the
+// public talaria name.
+func rewriteRedirect(c echo.Context, cfg *runtimeConfig, route *routing, status int, headers http.Header, body []byte, originalRequestScheme string) (*cachedRedirect, *forwardError) {
+	req := c.Request()
+	ctx := req.Context()
+
 	// Replace location header
-	location := c.Response().Header().Get("Location")
+	location := headers.Get("Location")
 	log.Ctx(ctx).Debug().Msgf("Location [%s]\n", location)
 
 	locationUrl, err := url.Parse(location)
 	if err != nil {
-		sentry.CaptureException(err)
-		panic(err)
-		return err
+		return nil, newForwardError(errInvalidLocation, err)
+	}
+	// Do replacement & build public talaria url
+	publicTalaria, err := route.talaria.mapHost(locationUrl.Hostname(), locationUrl.Port())
+	if err != nil {
+		return nil, newForwardError(errInvalidLocation, fmt.Errorf("%w: %s", err, location))
 	}
-	fixedScheme := viper.GetString("server.fixedScheme")
 
-	if fixedScheme != "" {
-		// TODO: use scheme from publicTalariaURL and make fixedScheme bool
-		// locationUrl.Scheme = publicTalariaURL.Scheme
-		locationUrl.Scheme = fixedScheme
+	if publicTalaria.Scheme != "" {
+		locationUrl.Scheme = publicTalaria.Scheme
+	} else if cfg.fixedScheme != "" {
+		locationUrl.Scheme = cfg.fixedScheme
 	} else {
 		locationUrl.Scheme = originalRequestScheme
 	}
 
-	// Do replacement & build public talaria url
-	externalTalariaName, err := replaceTalariaInternalName(
-		locationUrl.Hostname(),
-		viper.GetString(talariaInternal),
-		viper.GetString(talariaExternal),
-	)
-	if err != nil {
-		sentry.CaptureException(err)
-		return err
-	}
-	publicTalariaURL := buildExternalURL(externalTalariaName, viper.GetString(talariaDomain))
-
-	locationUrl.Host = publicTalariaURL
+	locationUrl.Host = publicTalaria.hostPort()
 	log.Ctx(ctx).Info().Msgf("redirecting from Location [%s] to Location [%s] for device name [%s] \n", location, locationUrl.String(), req.Header.Get("X-Webpa-Device-Name"))
-	c.Response().Header().Set("Location", locationUrl.String())
+	headers.Set("Location", locationUrl.String())
 
 	// Replace url in body
-	var href = regexp.MustCompile(`"(.*)"`)
-	body = href.ReplaceAll(body, []byte(`"`+locationUrl.String()+`"`))
-	c.Response().Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
-
-	// Forward status code
-	c.Response().Writer.WriteHeader(resp.StatusCode)
-
-	_, err = c.Response().Writer.Write(body)
+	body, err = rewriteBody(headers.Get("Content-Type"), body, location, locationUrl.String())
 	if err != nil {
-		sentry.CaptureException(err)
-		panic(err)
-		return err
+		// The Location header is all devices need, never send a
+		// body which still carries the internal name.
+		log.Ctx(ctx).Warn().Msgf("could not rewrite redirect body, dropping it: %v", err)
+		body = nil
 	}
+	headers.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	// Forward status code, normalized if configured
+	return &cachedRedirect{
+		status:   cfg.redirects.statusCode(status),
+		header:   headers,
+		body:     body,
+		storedAt: time.Now(),
+	}, nil
+}
 
-	return nil
+// streamResponse writes the already copied headers and the status code
+// of resp and pipes its body to the client using pooled, fixed size
+// buffers. Headers are flushed before the body so the client sees them
+// as soon as petasos sent them. Failures are told apart by the side
+// which failed: writing to the device or reading from petasos.
+func streamResponse(c echo.Context, resp *http.Response) *forwardError {
+	c.Response().WriteHeader(resp.StatusCode)
+	c.Response().Flush()
+
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+
+	w := &trackingWriter{w: c.Response()}
+	_, err := io.CopyBuffer(w, resp.Body, *buf)
+	if err == nil {
+		return nil
+	}
+	if w.err != nil {
+		return newForwardError(errClientDisconnected, err)
+	}
+	return classifyUpstreamError(c.Request().Context(), err)
 }
 
-// replaceTalariaInternalName replaces internal talaria name.
-// Returns a ErrNoMatchFound when replacement is impossible.
-func replaceTalariaInternalName(host, old, new string) (string, error) {
-	index := strings.Index(host, old)
-	if index == -1 {
-		return "", ErrNoMatchFound
+// trackingWriter remembers the first write error so a failed copy can be
+// attributed to the writing side.
+type trackingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil && t.err == nil {
+		t.err = err
 	}
-	talariaExternal := strings.Replace(host, old, new, -1)
-	return talariaExternal, nil
+	return n, err
+}
+
+// readRedirectBody reads a redirect body into memory. Bodies larger than
+// maxRedirectBodySize are rejected with ErrRedirectBodyTooLarge instead
+// of being buffered.
+func readRedirectBody(body io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxRedirectBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxRedirectBodySize {
+		return nil, ErrRedirectBodyTooLarge
+	}
+	return b, nil
 }
 
 // buildExternalURL by concatenation new talaria name + given domain
@@ -223,6 +371,26 @@ func buildExternalURL(newTalariaName, domain string) string {
 	return builder.String()
 }
 
+// updateResource updates the resource details unless the breaker of the
+// resource service is open. Failures are only logged, they never stop
+// the device from being redirected.
+func updateResource(route *routing, req *http.Request, client *http.Client) {
+	ctx := req.Context()
+	done, _, err := route.resourceBreaker.allow()
+	if err != nil {
+		log.Ctx(ctx).Warn().Msgf("skipping resource update: %v", err)
+		return
+	}
+
+	log.Ctx(ctx).Info().Msg("updating resource's IP address and certificate information")
+	startTime := time.Now()
+	err = updateResourceDetails(req, client, route.resourceURL)
+	done(err != nil, time.Since(startTime))
+	if err != nil {
+		log.Ctx(ctx).Error().Msg(err.Error())
+	}
+}
+
 /*
  * Extracts IP address, certificate provider, and expiry details from HTTP request headers.
  * Calls the RI API with this information.
@@ -257,6 +425,17 @@ func populateWebPaConveyHeaderDataIfPresent(webPAConveyHeader string, updatedRes
 	return nil
 }
 
+// firmwareVersion returns the fw-name of the X-WebPA-Convey header of req,
+// unknown if it is missing or can not be decoded.
+func firmwareVersion(req *http.Request) string {
+	var conveyHeaderData WebPAConveyHeaderData
+	decodedData, err := base64Decode(req.Header.Get(webpaConveyHeader))
+	if err != nil || json.Unmarshal(decodedData, &conveyHeaderData) != nil || conveyHeaderData.FwName == "" {
+		return unknownFirmware
+	}
+	return conveyHeaderData.FwName
+}
+
 func updateResourceDetails(req *http.Request, client *http.Client, resourceURL *url.URL) error {
 	certificateProviderRaw := req.Header.Get(certificateProviderHeader)
 	certificateProviderType := "DTSECURITY"
@@ -290,7 +469,7 @@ func updateResourceDetails(req *http.Request, client *http.Client, resourceURL *
 
 	//resourceURL = abc.com/v1/resource/macAddress
 	finalUrl := resourceURL.String() + "/" + cpeIdentifier
-	request, err := http.NewRequest(http.MethodPut, finalUrl, bytes.NewReader(jsonBytes))
+	request, err := http.NewRequestWithContext(req.Context(), http.MethodPut, finalUrl, bytes.NewReader(jsonBytes))
 	if err != nil {
 		return err
 	}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,48 +16,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestReplaceTalariaInternalName(t *testing.T) {
-
-	testData := []struct {
-		host     string
-		old      string
-		new      string
-		expected string
-		err      error
-	}{
-		{"xmidt-talaria-1", "xmidt-talaria-", "talaria", "talaria1", nil},
-		{"xmidt-talaria-2", "xmidt-talaria-", "talaria", "talaria2", nil},
-		{
-			host:     "xmidt-talaria3",
-			old:      "xmidt-talaria",
-			new:      "talaria",
-			expected: "talaria3",
-		},
-		{
-			host:     "xmidt-talaria4",
-			old:      "xmidt-talaria",
-			new:      "talaria",
-			expected: "talaria4",
-		},
-		{"xmidt-talaria4", "xmidt-talaria-", "talaria", "talaria4", ErrNoMatchFound},
-	}
-
-	for i, record := range testData {
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			var (
-				assert      = assert.New(t)
-				actual, err = replaceTalariaInternalName(record.host, record.old, record.new)
-			)
-			if err != nil {
-				assert.Equal(record.err, err)
-			} else {
-				assert.Equal(record.expected, actual)
-			}
-		})
-	}
-
-}
-
 func TestBuildExternalURL(t *testing.T) {
 	testData := []struct {
 		arg1     string
@@ -116,7 +76,7 @@ func TestForwarder(t *testing.T) {
 
 			server := httptest.NewServer(handler)
 			defer server.Close()
-			petasosURL, _ = url.Parse(server.URL)
+			routeToPetasos(t, server.URL)
 			r := httptest.NewRequest("", "/v2/api/device", nil)
 			r.Header.Set("X-Webpa-Device-Name", record.deviceName)
 			r.Header.Set("X-Forwarded-Proto", "ws")
@@ -133,6 +93,112 @@ func TestForwarder(t *testing.T) {
 		})
 	}
 }
+
+func TestForwarderStreamsNonRedirectBody(t *testing.T) {
+	var (
+		assert = assert.New(t)
+		body   = strings.Repeat("petasos", 64*1024)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/plain")
+		response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte(body))
+	}))
+	defer server.Close()
+	routeToPetasos(t, server.URL)
+
+	r := httptest.NewRequest("", "/v2/api/device", nil)
+	w := httptest.NewRecorder()
+	err := forwarder(echo.New().NewContext(r, w), &http.Client{})
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Equal(strconv.Itoa(len(body)), w.Header().Get("Content-Length"))
+	assert.Equal(body, w.Body.String())
+}
+
+func TestForwarderMethodsAndQuery(t *testing.T) {
+	testData := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{http.MethodGet, "/api/v2/device?lang=en", ""},
+		{http.MethodHead, "/api/v2/device", ""},
+		{http.MethodPost, "/api/v2/device?a=1&b=2", `{"name":"mac:112233445566"}`},
+		{http.MethodPut, "/api/v2/device/config?x=%20y", "payload"},
+		{http.MethodDelete, "/api/v2/device?force=true", ""},
+		{http.MethodOptions, "/api/v2/device", ""},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			expected, _ := url.Parse(record.target)
+
+			server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				body, err := io.ReadAll(request.Body)
+				assert.NoError(err)
+				assert.Equal(record.method, request.Method)
+				assert.Equal(expected.Path, request.URL.Path)
+				assert.Equal(expected.RawQuery, request.URL.RawQuery)
+				assert.Equal(record.body, string(body))
+				response.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+			routeToPetasos(t, server.URL)
+
+			r := httptest.NewRequest(record.method, record.target, strings.NewReader(record.body))
+			w := httptest.NewRecorder()
+			err := forwarder(echo.New().NewContext(r, w), &http.Client{})
+			assert.Nil(err)
+			assert.Equal(http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestReadRedirectBody(t *testing.T) {
+	testData := []struct {
+		size int
+		err  error
+	}{
+		{0, nil},
+		{128, nil},
+		{maxRedirectBodySize, nil},
+		{maxRedirectBodySize + 1, ErrRedirectBodyTooLarge},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var (
+				assert    = assert.New(t)
+				body, err = readRedirectBody(strings.NewReader(strings.Repeat("a", record.size)))
+			)
+			assert.Equal(record.err, err)
+			if err == nil {
+				assert.Len(body, record.size)
+			}
+		})
+	}
+}
+
+func TestFirmwareVersion(t *testing.T) {
+	testData := []struct {
+		convey   string
+		firmware string
+	}{
+		{base64.StdEncoding.EncodeToString([]byte(`{"fw-name":"005.033.001"}`)), "005.033.001"},
+		{base64.StdEncoding.EncodeToString([]byte(`{"hw-model":"FGA2233"}`)), unknownFirmware},
+		{"abcd1234", unknownFirmware},
+		{"", unknownFirmware},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v2/device", nil)
+			r.Header.Set(webpaConveyHeader, record.convey)
+			assert.Equal(t, record.firmware, firmwareVersion(r))
+		})
+	}
+}
+
 func TestUpdateResourceDetails(t *testing.T) {
 	testsData := []struct {
 		description                       string
@@ -5,11 +5,17 @@ go 1.14
 require (
 	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/benchkram/errz v0.0.0-20180520163740-571a80a661f2
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/getsentry/sentry-go v0.9.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/labstack/echo/v4 v4.12.0
+	github.com/mitchellh/mapstructure v1.1.2
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/prometheus/client_golang v0.9.3
 	github.com/rs/zerolog v1.19.0
+	github.com/spaolacci/murmur3 v1.1.0
 	github.com/spf13/cobra v1.0.0
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.4.0
 	github.com/stretchr/testify v1.8.4
 	go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho v0.19.0
@@ -20,7 +26,9 @@ require (
 	go.opentelemetry.io/otel/exporters/trace/zipkin v0.19.0
 	go.opentelemetry.io/otel/sdk v0.19.0
 	go.opentelemetry.io/otel/trace v0.19.0
+	golang.org/x/net v0.24.0
+	golang.org/x/sync v0.1.0
 	google.golang.org/api v0.41.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
-
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -1,30 +1,54 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 
 	"github.com/benchkram/errz"
+	"github.com/rs/zerolog/log"
 )
 
 // petasosHealth return nil if petasos is reachable
-func petasosHealth(u *url.URL) (err error) {
+func petasosHealth(client *http.Client, u *url.URL) (err error) {
 	defer errz.Recover(&err)
 
 	// check if petasos is reachable
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
 	req, err := http.NewRequest("GET", u.String(), nil)
 	errz.Fatal(err)
 
 	// Dummy device name, petasos requires it to be set.
 	req.Header.Set("X-Webpa-Device-Name", "mac:223344556677")
-	_, err = client.Do(req)
+	resp, err := client.Do(req)
 	errz.Fatal(err)
+	resp.Body.Close()
 
 	return nil
 }
+
+// routingsHealth checks the petasos backends of every routing. Unhealthy
+// backends are only logged, an error is returned if the pool of some
+// routing has no healthy backend at all.
+func routingsHealth(client *http.Client, routings []*routing) error {
+	var unavailable []string
+	for _, r := range routings {
+		if r.petasos == nil {
+			continue
+		}
+		healthy := 0
+		for _, u := range r.petasos.urls() {
+			if err := petasosHealth(client, u); err != nil {
+				log.Warn().Msgf("petasos [%s] of tenant [%s] is unhealthy: %v", u, r.tenant, err)
+				continue
+			}
+			healthy++
+		}
+		if healthy == 0 {
+			unavailable = append(unavailable, r.tenant)
+		}
+	}
+	if len(unavailable) > 0 {
+		return fmt.Errorf("no healthy petasos for tenants %v", unavailable)
+	}
+	return nil
+}
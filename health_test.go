@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestPetasosHealth(t *testing.T) {
@@ -18,10 +19,82 @@ func TestPetasosHealth(t *testing.T) {
 	server := httptest.NewServer(handler)
 	defer server.Close()
 	url, _ := url.Parse(server.URL)
-	err := petasosHealth(url)
+	err := petasosHealth(newUpstreamClient(UpstreamClientConfig{}, nil), url)
 	assert.Nil(err)
 	url, _ = url.Parse("http://127.0.0.1:1000/")
-	err = petasosHealth(url)
+	err = petasosHealth(newUpstreamClient(UpstreamClientConfig{}, nil), url)
 	assert.NotNil(err)
 
 }
+
+func TestUpstreamClientSettings(t *testing.T) {
+	assert := assert.New(t)
+	c := UpstreamClientConfig{
+		DialTimeout:           time.Second,
+		TLSHandshakeTimeout:   2 * time.Second,
+		ResponseHeaderTimeout: 3 * time.Second,
+		MaxIdleConnsPerHost:   7,
+		IdleConnTimeout:       time.Minute,
+		RequestTimeout:        4 * time.Second,
+	}
+
+	transport := newTransport(c)
+	assert.Equal(2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(3*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(7, transport.MaxIdleConnsPerHost)
+	assert.Equal(time.Minute, transport.IdleConnTimeout)
+	assert.Equal(4*time.Second, newUpstreamClient(c, transport).Timeout)
+}
+
+func TestUpstreamClientDefaults(t *testing.T) {
+	assert := assert.New(t)
+	defaults := http.DefaultTransport.(*http.Transport)
+	transport := newTransport(UpstreamClientConfig{})
+	assert.Equal(defaults.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(defaults.MaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(defaults.IdleConnTimeout, transport.IdleConnTimeout)
+	assert.NotNil(transport.DialContext)
+
+	// negative values keep the defaults too
+	transport = newTransport(UpstreamClientConfig{TLSHandshakeTimeout: -time.Second, MaxIdleConns: -1})
+	assert.Equal(defaults.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(defaults.MaxIdleConns, transport.MaxIdleConns)
+}
+
+func TestPetasosHealthTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+	url, _ := url.Parse(server.URL)
+	client := newUpstreamClient(UpstreamClientConfig{ResponseHeaderTimeout: 10 * time.Millisecond}, nil)
+	assert.NotNil(t, petasosHealth(client, url))
+}
+
+func TestRoutingsHealth(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+	defer server.Close()
+	const down = "http://127.0.0.1:1"
+
+	newRouting := func(tenant string, endpoints ...string) *routing {
+		pool, err := newBackendPool(PetasosConfig{Endpoints: endpoints})
+		assert.NoError(err)
+		return &routing{tenant: tenant, petasos: pool}
+	}
+	client := newUpstreamClient(UpstreamClientConfig{}, nil)
+
+	// an unhealthy backend is fine as long as another one of the pool is healthy
+	assert.NoError(routingsHealth(client, []*routing{
+		newRouting(defaultTenant, server.URL, down),
+		{tenant: "ring"},
+	}))
+
+	err := routingsHealth(client, []*routing{
+		newRouting(defaultTenant, server.URL),
+		newRouting("acme", down),
+	})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "acme")
+	}
+}
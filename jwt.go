@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons a bearer token is rejected for, each one is a label value of
+// the invalid token counter.
+const (
+	tokenMissing     = "missing"
+	tokenMalformed   = "malformed"
+	tokenAlgorithm   = "unsupported_algorithm"
+	tokenUnknownKey  = "unknown_key"
+	tokenSignature   = "invalid_signature"
+	tokenExpired     = "expired"
+	tokenNotYetValid = "not_yet_valid"
+	tokenIssuer      = "invalid_issuer"
+	tokenAudience    = "invalid_audience"
+)
+
+const (
+	bearerPrefix       = "Bearer "
+	authenticateHeader = "WWW-Authenticate"
+	// tokenFailureKey is the echo context key of the reason a token was
+	// rejected for.
+	tokenFailureKey = "tokenFailure"
+)
+
+// tokenError is returned when a bearer token is rejected.
+type tokenError struct {
+	Reason string
+	Err    error
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func newTokenError(reason string, format string, args ...interface{}) *tokenError {
+	return &tokenError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// JWTConfig is the `server.authHeader.jwt` section. Tokens are only
+// validated if jwksFile is set, otherwise the presence of the
+// Authorization header is checked.
+type JWTConfig struct {
+	JWKSFile  string        `mapstructure:"jwksFile"`
+	Issuer    string        `mapstructure:"issuer"`
+	Audience  []string      `mapstructure:"audience"`
+	ClockSkew time.Duration `mapstructure:"clockSkew"`
+}
+
+// jwtValidator validates bearer tokens against the keys of a local JWKS
+// file, which is reloaded whenever it changes.
+type jwtValidator struct {
+	file      string
+	issuer    string
+	audience  []string
+	clockSkew time.Duration
+	stop      func()
+
+	mu   sync.RWMutex
+	keys []*jsonWebKey
+}
+
+// newJWTValidator reads the JWKS file of c, nil is returned if none is
+// configured.
+func newJWTValidator(c JWTConfig) (*jwtValidator, error) {
+	if c.JWKSFile == "" {
+		return nil, nil
+	}
+	j := &jwtValidator{
+		file:      c.JWKSFile,
+		issuer:    c.Issuer,
+		audience:  c.Audience,
+		clockSkew: c.ClockSkew,
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	stop, err := watchFile(j.file, func() {
+		if err := j.load(); err != nil {
+			log.Error().Msgf("keeping JWKS keys, reloading [%s] failed: %v", j.file, err)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid server.authHeader.jwt.jwksFile: %v", err)
+	}
+	j.stop = stop
+	return j, nil
+}
+
+// load reads the signature keys of the JWKS file.
+func (j *jwtValidator) load() error {
+	content, err := ioutil.ReadFile(j.file)
+	if err != nil {
+		return fmt.Errorf("invalid server.authHeader.jwt.jwksFile: %v", err)
+	}
+	keys, err := parseJWKS(content)
+	if err != nil {
+		return fmt.Errorf("invalid server.authHeader.jwt.jwksFile [%s]: %v", j.file, err)
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+
+	log.Info().Msgf("loaded %d JWKS keys from [%s]", len(keys), j.file)
+	return nil
+}
+
+// close stops watching the JWKS file.
+func (j *jwtValidator) close() {
+	if j != nil && j.stop != nil {
+		j.stop()
+	}
+}
+
+// validate checks the bearer token of the Authorization header value:
+// its signature, issuer, audience, expiry and not-before. The claims of
+// a valid token are returned.
+func (j *jwtValidator) validate(authorization string) (*tokenClaims, *tokenError) {
+	if authorization == "" {
+		return nil, newTokenError(tokenMissing, "authorization header not provided")
+	}
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return nil, newTokenError(tokenMalformed, "authorization header is not a bearer token")
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := tokenParser.ParseWithClaims(strings.TrimSpace(authorization[len(bearerPrefix):]), claims, j.key)
+	if err != nil {
+		return nil, parseError(token, err)
+	}
+	if err := j.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return &tokenClaims{all: claims}, nil
+}
+
+// key is the jwt.Keyfunc looking up the key of the token kid, a token
+// without kid is verified with the only key of its algorithm.
+func (j *jwtValidator) key(token *jwt.Token) (interface{}, error) {
+	j.mu.RLock()
+	keys := j.keys
+	j.mu.RUnlock()
+
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+	var found *jsonWebKey
+	for _, key := range keys {
+		if (kid != "" && key.Kid != kid) || !key.accepts(alg) {
+			continue
+		}
+		if found != nil {
+			return nil, newTokenError(tokenUnknownKey, "several keys for algorithm [%s], the token has no kid", alg)
+		}
+		found = key
+	}
+	if found == nil {
+		return nil, newTokenError(tokenUnknownKey, "no key for kid [%s] and algorithm [%s]", kid, alg)
+	}
+	return found.publicKey, nil
+}
+
+// parseError maps the error of parsing token to the reason it is
+// rejected for.
+func parseError(token *jwt.Token, err error) *tokenError {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return &tokenError{Reason: tokenMalformed, Err: err}
+	}
+	if te, ok := ve.Inner.(*tokenError); ok {
+		return te
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return &tokenError{Reason: tokenMalformed, Err: err}
+	case token == nil || token.Method == nil || signatureAlgorithms[token.Method.Alg()].kty == "":
+		return &tokenError{Reason: tokenAlgorithm, Err: err}
+	}
+	return &tokenError{Reason: tokenSignature, Err: err}
+}
+
+// checkClaims checks the registered claims at now, exp is required.
+func (j *jwtValidator) checkClaims(claims jwt.MapClaims, now time.Time) *tokenError {
+	expiresAt, ok := claims["exp"].(float64)
+	if !ok {
+		return newTokenError(tokenMalformed, "exp is required")
+	}
+	if !claims.VerifyExpiresAt(now.Add(-j.clockSkew).Unix(), true) {
+		return newTokenError(tokenExpired, "token expired at %s", time.Unix(int64(expiresAt), 0).Format(time.RFC3339))
+	}
+	if !claims.VerifyNotBefore(now.Add(j.clockSkew).Unix(), false) {
+		return newTokenError(tokenNotYetValid, "token is not valid before %v", claims["nbf"])
+	}
+	if j.issuer != "" && !claims.VerifyIssuer(j.issuer, true) {
+		return newTokenError(tokenIssuer, "issuer [%v] is not [%s]", claims["iss"], j.issuer)
+	}
+	if len(j.audience) > 0 && !verifyAudience(claims, j.audience) {
+		return newTokenError(tokenAudience, "audience %v is not one of %v", claims["aud"], j.audience)
+	}
+	return nil
+}
+
+func verifyAudience(claims jwt.MapClaims, accepted []string) bool {
+	for _, aud := range accepted {
+		if claims.VerifyAudience(aud, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectToken answers a request whose token was rejected with 401. The
+// reason is passed on to the metrics middleware, missing headers are
+// already counted there.
+func rejectToken(c echo.Context, err *tokenError) error {
+	log.Ctx(c.Request().Context()).Error().Msgf("rejecting bearer token: %v", err)
+	challenge := fmt.Sprintf(`Bearer realm="%s"`, applicationName)
+	if err.Reason != tokenMissing {
+		c.Set(tokenFailureKey, err.Reason)
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description="%s"`, err.Reason)
+	}
+	c.Response().Header().Set(authenticateHeader, challenge)
+	return c.JSON(http.StatusUnauthorized, echo.NewHTTPError(http.StatusUnauthorized, err.Reason))
+}
+
+// tokenClaims are the claims of a valid token, all holds every claim for
+// the authorization rules.
+type tokenClaims struct {
+	all map[string]interface{}
+}
+
+// signatureAlgorithm is a JWS algorithm tokens may be signed with and
+// the type of the keys verifying it. Symmetric algorithms and none are
+// never accepted.
+type signatureAlgorithm struct {
+	kty string
+	crv string
+}
+
+var signatureAlgorithms = map[string]signatureAlgorithm{
+	"RS256": {"RSA", ""},
+	"RS384": {"RSA", ""},
+	"RS512": {"RSA", ""},
+	"PS256": {"RSA", ""},
+	"PS384": {"RSA", ""},
+	"PS512": {"RSA", ""},
+	"ES256": {"EC", "P-256"},
+	"ES384": {"EC", "P-384"},
+	"ES512": {"EC", "P-521"},
+	"EdDSA": {"OKP", "Ed25519"},
+}
+
+// tokenParser only accepts the signatureAlgorithms, the claims are
+// checked by checkClaims to honour the clock skew.
+var tokenParser = &jwt.Parser{
+	ValidMethods:         validMethods(),
+	SkipClaimsValidation: true,
+}
+
+func validMethods() []string {
+	methods := make([]string, 0, len(signatureAlgorithms))
+	for alg := range signatureAlgorithms {
+		methods = append(methods, alg)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// jsonWebKey is a public key of the JWKS file.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	publicKey crypto.PublicKey
+}
+
+// accepts tells whether tokens signed with alg may be verified with k.
+func (k *jsonWebKey) accepts(alg string) bool {
+	if k.Alg != "" && k.Alg != alg {
+		return false
+	}
+	algorithm := signatureAlgorithms[alg]
+	return k.Kty == algorithm.kty && k.Crv == algorithm.crv
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// parseJWKS returns the signature keys of a JWKS document. Keys for
+// encryption and of other types are skipped.
+func parseJWKS(content []byte) ([]*jsonWebKey, error) {
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make([]*jsonWebKey, 0, len(jwks.Keys))
+	for i, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		var err error
+		switch key.Kty {
+		case "RSA":
+			key.publicKey, err = key.rsaPublicKey()
+		case "EC":
+			key.publicKey, err = key.ecPublicKey()
+		case "OKP":
+			key.publicKey, err = key.ed25519PublicKey()
+		default:
+			log.Warn().Msgf("skipping JWKS key [%s] of unsupported type [%s]", key.Kid, key.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid keys[%d] [%s]: %v", i, key.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signature keys")
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt("n", k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt("e", k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid e")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k *jsonWebKey) ecPublicKey() (*ecdsa.PublicKey, error) {
+	curve, ok := curves[k.Crv]
+	if !ok {
+		return nil, fmt.Errorf("unsupported crv [%s]", k.Crv)
+	}
+	x, err := decodeBigInt("x", k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt("y", k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, fmt.Errorf("point is not on curve [%s]", k.Crv)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (k *jsonWebKey) ed25519PublicKey() (ed25519.PublicKey, error) {
+	if k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported crv [%s]", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid x")
+	}
+	return ed25519.PublicKey(x), nil
+}
+
+func decodeBigInt(name, value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testRSAKey, _      = rsa.GenerateKey(rand.Reader, 2048)
+	testOtherRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _       = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, testEdKey, _    = ed25519.GenerateKey(rand.Reader)
+)
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// testJWKS is a JWKS document with the public test keys.
+func testJWKS() string {
+	ecSize := (testECKey.Curve.Params().BitSize + 7) / 8
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": encodeSegment(testRSAKey.N.Bytes()), "e": encodeSegment(big.NewInt(int64(testRSAKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": encodeSegment(testECKey.X.FillBytes(make([]byte, ecSize))), "y": encodeSegment(testECKey.Y.FillBytes(make([]byte, ecSize)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encodeSegment(testEdKey.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}}
+	content, _ := json.Marshal(jwks)
+	return string(content)
+}
+
+// signTestToken returns a token with claims signed by key using alg.
+func signTestToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := encodeSegment(header) + "." + encodeSegment(payload)
+
+	var signature []byte
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}
+		require.NoError(t, err)
+	}
+	return signed + "." + encodeSegment(signature)
+}
+
+// newTestJWTValidator writes the test JWKS and returns a validator of it.
+func newTestJWTValidator(t *testing.T) (*jwtValidator, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "jwks")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "jwks.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(testJWKS()), 0644))
+
+	j, err := newJWTValidator(JWTConfig{
+		JWKSFile:  file,
+		Issuer:    "https://issuer.example.com",
+		Audience:  []string{"petasos-rewriter", "talaria"},
+		ClockSkew: time.Minute,
+	})
+	require.NoError(t, err)
+	t.Cleanup(j.close)
+	return j, file
+}
+
+func testClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "petasos-rewriter",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"nbf": time.Now().Add(-time.Hour).Unix(),
+	}
+	for key, value := range overrides {
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+	}
+	return claims
+}
+
+func TestJWTValidatorValidate(t *testing.T) {
+	j, _ := newTestJWTValidator(t)
+	now := time.Now()
+	valid := signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(nil))
+
+	testData := []struct {
+		authorization string
+		reason        string
+	}{
+		{"Bearer " + valid, ""},
+		{"bearer " + valid, ""},
+		{"Bearer " + signTestToken(t, "PS256", "rsa", testRSAKey, testClaims(nil)), ""},
+		{"Bearer " + signTestToken(t, "ES256", "ec", testECKey, testClaims(nil)), ""},
+		{"Bearer " + signTestToken(t, "EdDSA", "ed", testEdKey, testClaims(nil)), ""},
+		{"Bearer " + signTestToken(t, "RS256", "", testRSAKey, testClaims(nil)), ""},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"aud": []string{"other", "talaria"}})), ""},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), ""},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()})), ""},
+		{"", tokenMissing},
+		{valid, tokenMalformed},
+		{"Basic dXNlcjpwYXNz", tokenMalformed},
+		{"Bearer garbage", tokenMalformed},
+		{"Bearer a.b.c", tokenMalformed},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"exp": nil})), tokenMalformed},
+		{"Bearer " + signTestToken(t, "HS256", "hmac", testRSAKey, testClaims(nil)), tokenAlgorithm},
+		{"Bearer " + signTestToken(t, "none", "rsa", testRSAKey, testClaims(nil)), tokenAlgorithm},
+		{"Bearer " + signTestToken(t, "RS256", "missing", testRSAKey, testClaims(nil)), tokenUnknownKey},
+		{"Bearer " + signTestToken(t, "RS256", "ec", testRSAKey, testClaims(nil)), tokenUnknownKey},
+		{"Bearer " + signTestToken(t, "RS256", "enc", testRSAKey, testClaims(nil)), tokenUnknownKey},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testOtherRSAKey, testClaims(nil)), tokenSignature},
+		{"Bearer " + valid[:len(valid)-4] + "AAAA", tokenSignature},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})), tokenExpired},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})), tokenNotYetValid},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"iss": "https://evil.example.com"})), tokenIssuer},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"aud": "other"})), tokenAudience},
+		{"Bearer " + signTestToken(t, "RS256", "rsa", testRSAKey, testClaims(map[string]interface{}{"aud": nil})), tokenAudience},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			claims, err := j.validate(record.authorization)
+			if record.reason == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, "https://issuer.example.com", claims.all["iss"])
+				return
+			}
+			require.NotNil(t, err)
+			assert.Equal(t, record.reason, err.Reason, err.Error())
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	keys, err := parseJWKS([]byte(testJWKS()))
+	require.NoError(t, err)
+	assert.Len(t, keys, 3, "encryption and symmetric keys are skipped")
+
+	for _, content := range []string{
+		"not json",
+		`{"keys": []}`,
+		`{"keys": [{"kty": "RSA", "kid": "rsa", "n": "", "e": "AQAB"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`,
+		`{"keys": [{"kty": "OKP", "kid": "ed", "crv": "X25519", "x": "AQAB"}]}`,
+	} {
+		_, err := parseJWKS([]byte(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestJWTValidatorReloadsJWKSFile(t *testing.T) {
+	j, file := newTestJWTValidator(t)
+	token := "Bearer " + signTestToken(t, "RS256", "rotated", testOtherRSAKey, testClaims(nil))
+	_, err := j.validate(token)
+	require.NotNil(t, err)
+
+	jwks := `{"keys": [{"kty": "RSA", "kid": "rotated", "n": "` + encodeSegment(testOtherRSAKey.N.Bytes()) + `", "e": "AQAB"}]}`
+	require.NoError(t, ioutil.WriteFile(file, []byte(jwks), 0644))
+	assert.Eventually(t, func() bool {
+		_, err := j.validate(token)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// an invalid file keeps the keys
+	require.NoError(t, ioutil.WriteFile(file, []byte("{"), 0644))
+	time.Sleep(2 * watchDebounce)
+	_, err = j.validate(token)
+	assert.Nil(t, err)
+}
+
+func TestNewRuntimeConfigJWT(t *testing.T) {
+	_, file := newTestJWTValidator(t)
+	v := testViper(t, map[string]interface{}{
+		"petasos.endpoint":               "http://petasos:6400",
+		"talaria.internal":               "talaria",
+		"server.authHeader.jwt.jwksFile": file,
+	})
+	cfg, err := newRuntimeConfig(v, nil)
+	require.NoError(t, err)
+	assert.Nil(t, cfg.jwt, "tokens are only validated if the check is enabled")
+	cfg.close()
+
+	v.Set("authorization.rules", []map[string]interface{}{{"path": "/api/**", "capability": "x1:webpa"}})
+	_, err = newRuntimeConfig(v, nil)
+	assert.Error(t, err, "authorization needs bearer tokens")
+
+	v.Set("server.authHeader.check.enabled", true)
+	cfg, err = newRuntimeConfig(v, nil)
+	require.NoError(t, err)
+	defer cfg.close()
+	require.NotNil(t, cfg.jwt)
+	assert.Equal(t, 30*time.Second, cfg.jwt.clockSkew)
+
+	v.Set("server.authHeader.jwt.jwksFile", filepath.Join(filepath.Dir(file), "missing.json"))
+	_, err = newRuntimeConfig(v, nil)
+	assert.Error(t, err)
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"net/url"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -20,99 +21,139 @@ import (
 )
 
 const (
-	applicationName              = "petasos-rewriter"
-	serverPort                   = "server.port"
-	petasosEndpoint              = "petasos.endpoint"
-	talariaInternal              = "talaria.internal"
-	talariaExternal              = "talaria.external"
-	talariaDomain                = "talaria.domain"
-	zipkinName                   = "zipkin"
-	jaegarName                   = "jaegar"
-	noopName                     = "noop"
-	traceProviderType            = "type"
-	traceProviderEndpoint        = "endpoint"
-	traceProviderSkipTraceExport = "skipTraceExport"
-	spanIdHeader                 = "span-id"
-	traceIdHeader                = "trace-id"
-	remoteUpdateEndpoint         = "remoteUpdate.url"
-	metricsServerPort            = "metricsOptions.port"
+	applicationName = "petasos-rewriter"
+	stdoutName      = "stdout"
+	zipkinName      = "zipkin"
+	jaegerName      = "jaeger"
+	// jaegarName is the misspelled name accepted for compatibility
+	jaegarName     = "jaegar"
+	noopName       = "noop"
+	sentryDisabled = "NA"
+	spanIdHeader   = "span-id"
+	traceIdHeader  = "trace-id"
 )
 
-func init() {
+var (
+	// configFile is the --config flag
+	configFile string
+	// configErr is the error reading the configuration, only fatal when
+	// serving since validate-config reads its own file.
+	configErr error
+)
 
-	err := ConfigureViper(applicationName)
-	if err != nil {
-		errz.Fatal(err, "Could not read configuration")
-	}
+func init() {
+	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "",
+		fmt.Sprintf("configuration file, %s.yaml in /etc/%s, $HOME/.%s or . if not set", applicationName, applicationName, applicationName))
+	addConfigFlags(rootCmd.PersistentFlags())
+
+	validateConfigCmd.Flags().String("file", "", "configuration file to validate")
+	validateConfigCmd.MarkFlagRequired("file")
+	rootCmd.AddCommand(validateConfigCmd)
+
+	configDumpCmd.Flags().String("format", formatYAML, "output format, yaml or json")
+	configCmd.AddCommand(configDumpCmd)
+	rootCmd.AddCommand(configCmd)
+}
 
+// proxiedMethods are the methods forwarded to petasos
+var proxiedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodOptions,
 }
 
 var (
-	petasosURL                 *url.URL
-	sentryEnabled              = false
-	remoteUpdateAddressEnabled = false
-	resourceURL                *url.URL
-	isAuthHeaderCheckEnabled   = false
-	authHeaderCheckRequestPath = ""
+	sentryEnabled = false
 )
 
+// initConfig reads the configuration once the flags are parsed.
+func initConfig() {
+	configErr = readConfig(viper.GetViper(), configFile, rootCmd.PersistentFlags())
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "petasos-rewriter",
 	Short: "Request middleware implemented as `gateway`",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		printConfig()
-		logging(viper.Sub("log"))
-
-		isAuthHeaderCheckEnabled = viper.GetBool("server.authHeader.check.enabled")
-		authHeaderCheckRequestPath = viper.GetString("server.authHeader.check.requestPath")
+		if configErr != nil {
+			errz.Fatal(configErr, "Could not read configuration")
+		}
+		printConfig(cmd.Flags())
 
-		var err error
-		petasosURL, err = url.Parse(viper.GetString(petasosEndpoint))
+		config, err := loadConfig(viper.GetViper())
 		if err != nil {
 			log.Error().Msg(err.Error())
 			os.Exit(1)
 		}
-		fixedScheme := viper.GetString("server.fixedScheme")
-
-		if !(fixedScheme == "" || fixedScheme == "http" || fixedScheme == "https") {
-			log.Error().Msg(fmt.Errorf("Invalid Scheme [%s]", fixedScheme).Error())
+		discovered := newDiscovery(config.Discovery)
+		cfg, err := newRuntimeConfig(viper.GetViper(), discovered)
+		if err != nil {
+			log.Error().Msg(err.Error())
+			os.Exit(1)
+		}
+		logging(cfg.config.Log)
+		applyConfig(cfg)
+		deviceCache, err = newRedirectCache(cfg.config.Cache)
+		if err != nil {
+			log.Error().Msg(err.Error())
 			os.Exit(1)
 		}
 
-		ConfigureSentry(viper.Sub("sentry"))
+		ConfigureSentry(cfg.config.Sentry)
 
-		tp, err := configureTracerProvider(viper.Sub("traceProvider"), applicationName)
+		tp, err := configureTracerProvider(cfg.config.TraceProvider, applicationName)
 		if err != nil {
 			errz.Fatal(err, "Configuration is missing for trace provider, shutting down")
 
 		}
 
-		// Initial health check
-		log.Info().Msg("Checking if petasos is reachable")
+		// Initial health check, only fatal if some routing can not work
+		// without petasos
+		attempts := uint(10)
+		if !cfg.tenants.requiresPetasos() {
+			attempts = 1
+		}
+		hasPetasos := len(cfg.tenants.petasosURLs()) > 0
+		if hasPetasos {
+			log.Info().Msg("Checking if petasos is reachable")
+		}
+		healthClient := newUpstreamClient(cfg.config.Upstream.Client, nil)
 
 		attempt := 1
 		err = retry.Do(
 			func() error {
+				if !hasPetasos {
+					return nil
+				}
 				log.Debug().Msgf("Trying to reach petasos: [attempt: %d]", attempt)
 
 				attempt++
 
-				err = petasosHealth(petasosURL)
+				err := routingsHealth(healthClient, cfg.tenants.all())
 				if err != nil {
 					sentry.CaptureException(err)
 					sentry.Flush(2 * time.Second)
-					return fmt.Errorf("unhealthy")
 				}
-				return nil
+				return err
 			},
-			retry.Attempts(10),
+			retry.Attempts(attempts),
 			retry.Delay(1*time.Second),
 		)
-		sentry.WithScope(func(scope *sentry.Scope) {
-			scope.SetLevel(sentry.LevelFatal)
-			sentry.CaptureMessage("Could not reach petasos, shutting down")
-		})
+		if err != nil && !cfg.tenants.requiresPetasos() {
+			log.Warn().Msg("Could not reach petasos, talaria is assigned without it")
+			err = nil
+		}
+		if err != nil {
+			sentry.WithScope(func(scope *sentry.Scope) {
+				scope.SetLevel(sentry.LevelFatal)
+				sentry.CaptureMessage("Could not reach petasos, shutting down")
+			})
+		}
 		errz.Fatal(err, "Could not reach petasos, shutting down")
 		prop := propagation.TraceContext{}
 		otelEchoOptions := []otelecho.Option{
@@ -120,16 +161,7 @@ var rootCmd = &cobra.Command{
 			otelecho.WithTracerProvider(tp),
 		}
 
-		remoteUpdateAddressEnabled = viper.GetBool("remoteUpdate.enable")
-		if remoteUpdateAddressEnabled {
-			resourceURL, err = url.Parse(viper.GetString(remoteUpdateEndpoint))
-			if err != nil {
-				log.Error().Msg(err.Error())
-				remoteUpdateAddressEnabled = false
-			}
-		}
-
-		client := configureClient(prop, tp)
+		client := configureClient(cfg.config.Upstream.Client, prop, tp)
 		// Setup & Start Server
 		e := echo.New()
 		e.Use(middleware.Logger())
@@ -143,13 +175,61 @@ var rootCmd = &cobra.Command{
 
 		}
 		// Setup prometheus
-		provideMetrics(e)
+		provideMetrics(e, cfg.config.MetricsOptions)
+		// Reload the configuration on change
+		reloader = newConfigReloader(viper.ConfigFileUsed(), discovered, cmd.Flags())
+		if err := reloader.start(); err != nil {
+			log.Error().Msg(err.Error())
+			os.Exit(1)
+		}
+		defer reloader.stop()
 		requestHandlerFunc := func(ctx echo.Context) error {
 			return forwarder(ctx, client)
 		}
 
-		e.GET("/api/*", requestHandlerFunc)
-		e.Logger.Fatal(e.Start(":" + viper.GetString(serverPort)))
+		e.Match(proxiedMethods, "/api/*", requestHandlerFunc, checkCertificate(), authenticate(), authorize())
+		e.Logger.Fatal(e.Start(":" + strconv.Itoa(cfg.config.Server.Port)))
+	},
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config",
+	Short: "Validate a configuration file and exit non-zero if it is invalid",
+	Args:  cobra.NoArgs,
+	// the error is logged by main, usage is only helpful for flag errors
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, _ := cmd.Flags().GetString("file")
+		v := viper.New()
+		if err := readConfig(v, file, cmd.Flags()); err != nil {
+			return fmt.Errorf("could not read configuration [%s]: %v", file, err)
+		}
+		if err := validateConfig(v); err != nil {
+			return fmt.Errorf("invalid configuration [%s]: %v", file, err)
+		}
+		fmt.Printf("configuration [%s] is valid\n", file)
+		return nil
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:           "dump",
+	Short:         "Print the effective configuration with secrets masked and the source of each value",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configErr != nil {
+			return fmt.Errorf("could not read configuration: %v", configErr)
+		}
+		format, _ := cmd.Flags().GetString("format")
+		return dumpConfig(viper.GetViper(), cmd.Flags(), format, cmd.OutOrStdout())
 	},
 }
 
@@ -1 +1,17 @@
 package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// TestMain reads petasos-rewriter.yaml like the command does, the tests
+// share its settings.
+func TestMain(m *testing.M) {
+	if err := readConfig(viper.GetViper(), "", nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Policies for hosts no mapping rule matches
+const (
+	unmatchedError       = "error"
+	unmatchedPassthrough = "passthrough"
+	unmatchedDefault     = "default"
+)
+
+// Policies for the port of the Location petasos sent
+const (
+	portKeep = "keep"
+	portDrop = "drop"
+	portMap  = "map"
+)
+
+// mappingRule rewrites hosts matching Match. Replace may reference
+// capture groups of Match, e.g. `talaria$1`.
+type mappingRule struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+	Domain  string `mapstructure:"domain"`
+	Port    int    `mapstructure:"port"`
+	Scheme  string `mapstructure:"scheme"`
+
+	re *regexp.Regexp
+}
+
+// mappingTarget is used for hosts no rule matches when the unmatched
+// policy is `default`.
+type mappingTarget struct {
+	Host   string `mapstructure:"host"`
+	Domain string `mapstructure:"domain"`
+	Port   int    `mapstructure:"port"`
+	Scheme string `mapstructure:"scheme"`
+}
+
+// mappedHost is the public talaria a Location is rewritten to. Port is
+// 0 when the Location carries no port, Scheme is empty when the Location
+// one has to be used.
+type mappedHost struct {
+	Host   string
+	Port   int
+	Scheme string
+}
+
+// hostMapper applies an ordered list of rules, the first matching rule wins.
+type hostMapper struct {
+	rules           []mappingRule
+	unmatchedPolicy string
+	defaultTarget   mappingTarget
+	portPolicy      string
+	portMap         map[string]int
+}
+
+// newHostMapper builds the mapper from the `talaria` section. Without
+// `rules` the legacy internal/external/domain keys form a single rule
+// which replaces every occurrence of internal by external.
+func newHostMapper(c TalariaConfig) (*hostMapper, error) {
+	m := &hostMapper{
+		rules:           c.Rules,
+		unmatchedPolicy: c.Unmatched.Policy,
+		defaultTarget:   c.Unmatched.Default,
+		portPolicy:      c.Port.Policy,
+	}
+	if m.unmatchedPolicy == "" {
+		m.unmatchedPolicy = unmatchedError
+	}
+	if m.portPolicy == "" {
+		m.portPolicy = portDrop
+	}
+
+	if m.rules == nil {
+		m.rules = []mappingRule{{
+			Match:   regexp.QuoteMeta(c.Internal),
+			Replace: c.External,
+			Domain:  c.Domain,
+		}}
+	} else {
+		// the rules are compiled in place, keep c untouched
+		m.rules = append([]mappingRule(nil), m.rules...)
+	}
+
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if rule.Match == "" {
+			return nil, fmt.Errorf("invalid talaria.rules[%d].match: must not be empty", i)
+		}
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid talaria.rules[%d].match: %v", i, err)
+		}
+		rule.re = re
+		if err := validateTarget(rule.Scheme, rule.Port); err != nil {
+			return nil, fmt.Errorf("invalid talaria.rules[%d]: %v", i, err)
+		}
+	}
+
+	switch m.unmatchedPolicy {
+	case unmatchedError, unmatchedPassthrough:
+	case unmatchedDefault:
+		if m.defaultTarget.Host == "" {
+			return nil, fmt.Errorf("invalid talaria.unmatched.default.host: must not be empty")
+		}
+		if err := validateTarget(m.defaultTarget.Scheme, m.defaultTarget.Port); err != nil {
+			return nil, fmt.Errorf("invalid talaria.unmatched.default: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid talaria.unmatched.policy [%s], must be one of [%s, %s, %s]",
+			m.unmatchedPolicy, unmatchedError, unmatchedPassthrough, unmatchedDefault)
+	}
+
+	switch m.portPolicy {
+	case portKeep, portDrop:
+	case portMap:
+		m.portMap = make(map[string]int)
+		for internal, port := range c.Port.Map {
+			if _, err := strconv.ParseUint(internal, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid talaria.port.map key [%s]: %v", internal, err)
+			}
+			if port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid talaria.port.map.%s [%d]", internal, port)
+			}
+			m.portMap[internal] = port
+		}
+	default:
+		return nil, fmt.Errorf("invalid talaria.port.policy [%s], must be one of [%s, %s, %s]",
+			m.portPolicy, portKeep, portDrop, portMap)
+	}
+	return m, nil
+}
+
+func validateTarget(scheme string, port int) error {
+	if !(scheme == "" || scheme == "http" || scheme == "https") {
+		return fmt.Errorf("invalid scheme [%s]", scheme)
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port [%d]", port)
+	}
+	return nil
+}
+
+// mapHost returns the public talaria for an internal talaria host name
+// and port, as returned by url.URL Hostname and Port. A port set by the
+// matching rule or default target wins over the port policy.
+// Returns ErrNoMatchFound when no rule matches and the policy is `error`.
+func (m *hostMapper) mapHost(host, port string) (mappedHost, error) {
+	for _, rule := range m.rules {
+		if !rule.re.MatchString(host) {
+			continue
+		}
+		return mappedHost{
+			Host:   withDomain(rule.re.ReplaceAllString(host, rule.Replace), rule.Domain),
+			Port:   m.mapPort(port, rule.Port),
+			Scheme: rule.Scheme,
+		}, nil
+	}
+
+	switch m.unmatchedPolicy {
+	case unmatchedPassthrough:
+		return mappedHost{Host: host, Port: m.mapPort(port, 0)}, nil
+	case unmatchedDefault:
+		return mappedHost{
+			Host:   withDomain(m.defaultTarget.Host, m.defaultTarget.Domain),
+			Port:   m.mapPort(port, m.defaultTarget.Port),
+			Scheme: m.defaultTarget.Scheme,
+		}, nil
+	default:
+		return mappedHost{}, ErrNoMatchFound
+	}
+}
+
+// mapPort applies the port policy to the Location port, unless the
+// target has a fixed port. Ports without mapping are dropped.
+func (m *hostMapper) mapPort(port string, targetPort int) int {
+	if targetPort != 0 {
+		return targetPort
+	}
+	switch m.portPolicy {
+	case portKeep:
+		p, _ := strconv.Atoi(port)
+		return p
+	case portMap:
+		return m.portMap[port]
+	default:
+		return 0
+	}
+}
+
+// hostPort returns the value for a URL Host field, IPv6 literals are
+// bracketed.
+func (h mappedHost) hostPort() string {
+	if h.Port == 0 {
+		if strings.Contains(h.Host, ":") {
+			return "[" + h.Host + "]"
+		}
+		return h.Host
+	}
+	return net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+}
+
+// withDomain appends domain to name, unless name already is part of it.
+func withDomain(name, domain string) string {
+	if domain == "" || name == domain || strings.HasSuffix(name, "."+domain) {
+		return name
+	}
+	return buildExternalURL(name, domain)
+}
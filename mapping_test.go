@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHostMapper(t *testing.T, settings map[string]interface{}) (*hostMapper, error) {
+	t.Helper()
+	c, err := loadConfig(testViper(t, settings))
+	if err != nil {
+		return nil, err
+	}
+	return newHostMapper(c.Talaria)
+}
+
+// TestHostMapperLegacyRule runs the cases of the former
+// TestReplaceTalariaInternalName through the talaria.internal, external
+// and domain keys existing configurations use.
+func TestHostMapperLegacyRule(t *testing.T) {
+	testData := []struct {
+		host     string
+		old      string
+		new      string
+		expected string
+		err      error
+	}{
+		{"xmidt-talaria-1", "xmidt-talaria-", "talaria", "talaria1.test.com", nil},
+		{"xmidt-talaria-2", "xmidt-talaria-", "talaria", "talaria2.test.com", nil},
+		{
+			host:     "xmidt-talaria3",
+			old:      "xmidt-talaria",
+			new:      "talaria",
+			expected: "talaria3.test.com",
+		},
+		{
+			host:     "xmidt-talaria4",
+			old:      "xmidt-talaria",
+			new:      "talaria",
+			expected: "talaria4.test.com",
+		},
+		{"xmidt.talaria5", "xmidt.", "", "talaria5.test.com", nil},
+		{"xmidt-talaria4", "xmidt-talaria-", "talaria", "", ErrNoMatchFound},
+		{"xmidtXtalaria6", "xmidt.", "", "", ErrNoMatchFound},
+	}
+
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			m, err := newTestHostMapper(t, map[string]interface{}{
+				"talaria.internal": record.old,
+				"talaria.external": record.new,
+				"talaria.domain":   "test.com",
+			})
+			assert.NoError(err)
+			actual, err := m.mapHost(record.host, "")
+			assert.Equal(record.err, err)
+			assert.Equal(record.expected, actual.Host)
+
+			v := testViper(t, map[string]interface{}{
+				"petasos.endpoint": "http://petasos:6400",
+				"talaria.internal": record.old,
+				"talaria.external": record.new,
+				"talaria.domain":   "test.com",
+			})
+			r, err := newRouting(defaultTenant, loadTestConfig(t, v).RoutingConfig)
+			assert.NoError(err)
+			actual, err = r.talaria.mapHost(record.host, "")
+			assert.Equal(record.err, err)
+			assert.Equal(record.expected, actual.Host)
+		})
+	}
+}
+
+func TestHostMapperRules(t *testing.T) {
+	settings := map[string]interface{}{
+		"talaria.rules": []map[string]interface{}{
+			{"match": `^xmidt-talaria-(\d+)$`, "replace": "talaria$1", "domain": "eu.example.com"},
+			{"match": `^talaria-(\w+)-(\d+)\.svc$`, "replace": "${1}-talaria${2}", "domain": "example.com", "port": 443, "scheme": "https"},
+			{"match": `^xmidt-`, "replace": "", "domain": "fallback.example.com"},
+		},
+	}
+	testData := []struct {
+		policy   string
+		host     string
+		expected mappedHost
+		err      error
+	}{
+		{"", "xmidt-talaria-1", mappedHost{Host: "talaria1.eu.example.com"}, nil},
+		{"", "talaria-us-2.svc", mappedHost{Host: "us-talaria2.example.com", Port: 443, Scheme: "https"}, nil},
+		{"", "xmidt-talaria-x", mappedHost{Host: "talaria-x.fallback.example.com"}, nil},
+		{"", "unknown", mappedHost{}, ErrNoMatchFound},
+		{unmatchedError, "unknown", mappedHost{}, ErrNoMatchFound},
+		{unmatchedPassthrough, "unknown", mappedHost{Host: "unknown"}, nil},
+		{unmatchedDefault, "unknown", mappedHost{Host: "talaria.example.com", Port: 8443, Scheme: "https"}, nil},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			s := map[string]interface{}{
+				"talaria.rules":            settings["talaria.rules"],
+				"talaria.unmatched.policy": record.policy,
+				"talaria.unmatched.default": map[string]interface{}{
+					"host": "talaria", "domain": "example.com", "port": 8443, "scheme": "https",
+				},
+			}
+			m, err := newTestHostMapper(t, s)
+			assert.NoError(err)
+			actual, err := m.mapHost(record.host, "")
+			assert.Equal(record.err, err)
+			assert.Equal(record.expected, actual)
+		})
+	}
+}
+
+func TestNewHostMapperInvalid(t *testing.T) {
+	testData := []map[string]interface{}{
+		{"talaria.rules": []map[string]interface{}{{"match": ""}}},
+		{"talaria.rules": []map[string]interface{}{{"match": "("}}},
+		{"talaria.rules": []map[string]interface{}{{"match": "a", "scheme": "ws"}}},
+		{"talaria.rules": []map[string]interface{}{{"match": "a", "port": 70000}}},
+		{"talaria.unmatched.policy": "ignore"},
+		{"talaria.unmatched.policy": unmatchedDefault},
+		{"talaria.port.policy": "rewrite"},
+		{"talaria.port.policy": portMap, "talaria.port.map": map[string]interface{}{"6200": "https"}},
+		{"talaria.port.policy": portMap, "talaria.port.map": map[string]interface{}{"x": 443}},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := newTestHostMapper(t, record)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHostMapperPortsAndIPv6(t *testing.T) {
+	testData := []struct {
+		location string
+		policy   string
+		rulePort int
+		expected string
+	}{
+		{"http://talaria-1:6200/api/v2/device", portDrop, 0, "talaria-1.example.com"},
+		{"http://talaria-1:6200/api/v2/device", "", 0, "talaria-1.example.com"},
+		{"http://talaria-1:6200/api/v2/device", portKeep, 0, "talaria-1.example.com:6200"},
+		{"http://talaria-1:6200/api/v2/device", portMap, 0, "talaria-1.example.com:443"},
+		{"http://talaria-1:6201/api/v2/device", portMap, 0, "talaria-1.example.com"},
+		{"http://talaria-1/api/v2/device", portKeep, 0, "talaria-1.example.com"},
+		{"http://talaria-1:6200/api/v2/device", portKeep, 8443, "talaria-1.example.com:8443"},
+		{"http://talaria-1.example.com:6200/api/v2/device", portKeep, 0, "talaria-1.example.com:6200"},
+		{"http://talaria-1.example.com/api/v2/device", portDrop, 0, "talaria-1.example.com"},
+		{"http://[fd00::1]:6200/api/v2/device", portKeep, 0, "[fd00::1]:6200"},
+		{"http://[fd00::1]:6200/api/v2/device", portMap, 0, "[fd00::1]:443"},
+		{"http://[fd00::1]:6200/api/v2/device", portDrop, 0, "[fd00::1]"},
+		{"http://[fd00::1]/api/v2/device", portKeep, 0, "[fd00::1]"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			m, err := newTestHostMapper(t, map[string]interface{}{
+				"talaria.rules": []map[string]interface{}{
+					{"match": `^talaria-\d+`, "replace": "$0", "domain": "example.com", "port": record.rulePort},
+				},
+				"talaria.unmatched.policy": unmatchedPassthrough,
+				"talaria.port.policy":      record.policy,
+				"talaria.port.map":         map[string]interface{}{"6200": 443},
+			})
+			assert.NoError(err)
+
+			location, err := url.Parse(record.location)
+			assert.NoError(err)
+			actual, err := m.mapHost(location.Hostname(), location.Port())
+			assert.NoError(err)
+			assert.Equal(record.expected, actual.hostPort())
+
+			location.Host = actual.hostPort()
+			_, err = url.Parse(location.String())
+			assert.NoError(err)
+		})
+	}
+}
@@ -4,30 +4,48 @@ import (
 	"strconv"
 	"time"
 
-	"strings"
-
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/spf13/viper"
 )
 
-var labelNames = []string{"code", "method", "host", "url"}
+var labelNames = []string{"code", "method", "host", "url", "tenant"}
+
+// registry is set once metrics are provided, it is nil in tests which
+// call handlers directly.
+var registry *metricRegistry
 
 type metricRegistry struct {
 	TotalRequests             *prometheus.CounterVec
 	ServerRequestDuration     *prometheus.HistogramVec
 	RequestsWithoutAuthHeader *prometheus.CounterVec
 	RequestsWithAuthHeader    *prometheus.CounterVec
+	RequestsWithInvalidToken  *prometheus.CounterVec
+	RequestsDenied            *prometheus.CounterVec
+	AuthAuditFailures         *prometheus.CounterVec
+	CertificateViolations     *prometheus.CounterVec
+	ForwardErrors             map[errorKind]prometheus.Counter
+	BackendRequests           *prometheus.CounterVec
+	BackendRequestDuration    *prometheus.HistogramVec
+	BackendEjections          *prometheus.CounterVec
+	CircuitBreakerState       *prometheus.GaugeVec
+	RedirectCacheHits         *prometheus.CounterVec
+	RedirectCacheMisses       *prometheus.CounterVec
+	RedirectCacheEvictions    *prometheus.CounterVec
+	RedirectCacheStaleServes  *prometheus.CounterVec
+	CoalescedRequests         *prometheus.CounterVec
+	DiscoveryLastReload       prometheus.Gauge
+	DiscoveryReloadErrors     prometheus.Counter
+	ConfigReloads             *prometheus.CounterVec
 }
 
-func provideMetrics(e *echo.Echo) {
+func provideMetrics(e *echo.Echo, c MetricsConfig) {
 	metrics := echo.New()
 	metrics.Use(middleware.Logger())
 	metrics.Use(middleware.Recover())
 
-	mr := registerMetrics()
+	mr := registerMetrics(c)
 
 	if err := prometheus.Register(mr.TotalRequests); err != nil {
 		metrics.Logger.Fatal(err)
@@ -41,26 +59,78 @@ func provideMetrics(e *echo.Echo) {
 	if err := prometheus.Register(mr.RequestsWithAuthHeader); err != nil {
 		metrics.Logger.Fatal(err)
 	}
+	if err := prometheus.Register(mr.RequestsWithInvalidToken); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.RequestsDenied); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.AuthAuditFailures); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.CertificateViolations); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.BackendRequests); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.BackendRequestDuration); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.BackendEjections); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.CircuitBreakerState); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.RedirectCacheHits); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.RedirectCacheMisses); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.RedirectCacheEvictions); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.RedirectCacheStaleServes); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.CoalescedRequests); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.DiscoveryLastReload); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.DiscoveryReloadErrors); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	if err := prometheus.Register(mr.ConfigReloads); err != nil {
+		metrics.Logger.Fatal(err)
+	}
+	for _, counter := range mr.ForwardErrors {
+		if err := prometheus.Register(counter); err != nil {
+			metrics.Logger.Fatal(err)
+		}
+	}
+	registry = mr
 
 	metrics.Use(mr.getMiddleware())
 	metrics.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	if c.AdminReload {
+		metrics.GET("/admin/config/reload", reloadStatusHandler)
+		metrics.POST("/admin/config/reload", reloadHandler)
+	}
 
 	go func() {
-		metrics.Logger.Fatal(metrics.Start(":" + viper.GetString(metricsServerPort)))
+		metrics.Logger.Fatal(metrics.Start(":" + strconv.Itoa(c.Port)))
 	}()
 
 	e.Use(mr.getMiddleware())
 }
 
-func registerMetrics() *metricRegistry {
-	namespace := viper.GetString("metricsOptions.namespace")
-	if len(namespace) == 0 {
-		namespace = "xmidt"
-	}
-	subsystem := viper.GetString("metricsOptions.subsystem")
-	if len(subsystem) == 0 {
-		subsystem = "petasos_rewriter"
-	}
+func registerMetrics(c MetricsConfig) *metricRegistry {
+	namespace := c.Namespace
+	subsystem := c.Subsystem
 
 	totalRequests := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -103,18 +173,207 @@ func registerMetrics() *metricRegistry {
 		labelNames,
 	)
 
+	requestsWithInvalidToken := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "server_request_with_invalid_auth_token_count",
+			Help:      "total requests whose bearer token was rejected by reason",
+		},
+		append(append([]string{}, labelNames...), "reason"),
+	)
+
+	requestsDenied := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "server_request_denied_count",
+			Help:      "total requests denied by the authorization rules by reason",
+		},
+		append(append([]string{}, labelNames...), "reason"),
+	)
+
+	authAuditFailures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "auth_audit_failure_count",
+			Help:      "total requests the auth check would have rejected in audit mode by tenant, firmware and reason",
+		},
+		[]string{"tenant", "firmware", "reason"},
+	)
+
+	certificateViolations := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "certificate_policy_violation_count",
+			Help:      "total requests whose device certificate violates a certificate policy rule",
+		},
+		[]string{"rule", "reason", "mode", "tenant"},
+	)
+
+	forwardErrors := make(map[errorKind]prometheus.Counter, len(errorKinds))
+	for _, kind := range errorKinds {
+		forwardErrors[kind] = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "forward_error_" + string(kind) + "_count",
+				Help:      "total requests which failed with " + errorTitles[kind],
+			},
+		)
+	}
+
+	backendRequests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "petasos_backend_request_count",
+			Help:      "total requests sent to each petasos backend",
+		},
+		[]string{"backend", "outcome"},
+	)
+
+	backendRequestDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "petasos_backend_request_duration_seconds",
+			Help:      "tracks petasos backend response times in seconds",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"backend"},
+	)
+
+	backendEjections := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "petasos_backend_ejection_count",
+			Help:      "total ejections of each petasos backend",
+		},
+		[]string{"backend"},
+	)
+
+	circuitBreakerState := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "state of the circuit breaker of each upstream: 0 closed, 1 open, 2 half-open",
+		},
+		[]string{"upstream", "tenant"},
+	)
+
+	redirectCacheHits := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redirect_cache_hit_count",
+			Help:      "total requests answered from the redirect cache",
+		},
+		[]string{"tenant"},
+	)
+
+	redirectCacheMisses := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redirect_cache_miss_count",
+			Help:      "total cacheable requests without a fresh redirect cache entry",
+		},
+		[]string{"tenant"},
+	)
+
+	redirectCacheEvictions := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redirect_cache_eviction_count",
+			Help:      "total redirect cache entries evicted because the cache was full",
+		},
+		[]string{"tenant"},
+	)
+
+	redirectCacheStaleServes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redirect_cache_stale_count",
+			Help:      "total requests answered with a stale redirect cache entry because petasos could not be asked",
+		},
+		[]string{"tenant"},
+	)
+
+	coalescedRequests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "petasos_coalesced_request_count",
+			Help:      "total requests answered with the petasos lookup of a concurrent request for the same device",
+		},
+		[]string{"tenant"},
+	)
+
+	discoveryLastReload := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "discovery_last_reload_timestamp",
+			Help:      "unix time the endpoints were last loaded from the discovery file",
+		},
+	)
+
+	discoveryReloadErrors := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "discovery_reload_error_count",
+			Help:      "total failed reloads of the discovery file",
+		},
+	)
+
+	configReloads := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "config_reload_count",
+			Help:      "total configuration reloads by trigger and outcome",
+		},
+		[]string{"trigger", "outcome"},
+	)
+
 	return &metricRegistry{
 		TotalRequests:             totalRequests,
 		ServerRequestDuration:     serverRequestDuration,
 		RequestsWithoutAuthHeader: requestsWithoutAuthHeader,
 		RequestsWithAuthHeader:    requestsWithAuthHeader,
+		RequestsWithInvalidToken:  requestsWithInvalidToken,
+		RequestsDenied:            requestsDenied,
+		AuthAuditFailures:         authAuditFailures,
+		CertificateViolations:     certificateViolations,
+		ForwardErrors:             forwardErrors,
+		BackendRequests:           backendRequests,
+		BackendRequestDuration:    backendRequestDuration,
+		BackendEjections:          backendEjections,
+		CircuitBreakerState:       circuitBreakerState,
+		RedirectCacheHits:         redirectCacheHits,
+		RedirectCacheMisses:       redirectCacheMisses,
+		RedirectCacheEvictions:    redirectCacheEvictions,
+		RedirectCacheStaleServes:  redirectCacheStaleServes,
+		CoalescedRequests:         coalescedRequests,
+		DiscoveryLastReload:       discoveryLastReload,
+		DiscoveryReloadErrors:     discoveryReloadErrors,
+		ConfigReloads:             configReloads,
 	}
 }
 
 func (mr *metricRegistry) getMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			isCpeRedirectRequest := strings.Contains(c.Request().RequestURI, authHeaderCheckRequestPath)
+			cfg := currentConfig()
+			isCpeRedirectRequest := cfg.authPolicies.lookup(c.Request()) != authNone
 			isAuthHeaderPresent := len(c.Request().Header.Get("Authorization")) > 0
 			c.Request().Header.Set("Accept-Encoding", "identity")
 
@@ -128,6 +387,7 @@ func (mr *metricRegistry) getMiddleware() echo.MiddlewareFunc {
 			values[1] = c.Request().Method
 			values[2] = c.Request().Host
 			values[3] = c.Path()
+			values[4] = cfg.tenants.label(c.Request().Header.Get(tenantHeader))
 
 			mr.TotalRequests.WithLabelValues(values...).Inc()
 			mr.ServerRequestDuration.WithLabelValues(values...).Observe(elapsed)
@@ -139,6 +399,12 @@ func (mr *metricRegistry) getMiddleware() echo.MiddlewareFunc {
 					mr.RequestsWithAuthHeader.WithLabelValues(values...).Inc()
 				}
 			}
+			if reason, ok := c.Get(tokenFailureKey).(string); ok {
+				mr.RequestsWithInvalidToken.WithLabelValues(append(values, reason)...).Inc()
+			}
+			if reason, ok := c.Get(denialKey).(string); ok {
+				mr.RequestsDenied.WithLabelValues(append(values, reason)...).Inc()
+			}
 			return err
 		}
 	}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Auth requirements of a path policy
+const (
+	// authNone does not check the Authorization header
+	authNone = "none"
+	// authPresence requires an Authorization header
+	authPresence = "presence"
+	// authJWT requires a bearer token valid for the JWKS keys
+	authJWT = "jwt"
+)
+
+// authPolicy is the auth requirement of requests whose path matches Path,
+// a glob, or PathRegex, an anchored regular expression, and whose method
+// is one of Methods, every method if empty. In globs * matches within a
+// path segment, ** across segments and ? a single character.
+type authPolicy struct {
+	Path      string   `mapstructure:"path"`
+	PathRegex string   `mapstructure:"pathRegex"`
+	Methods   []string `mapstructure:"methods"`
+	Auth      string   `mapstructure:"auth"`
+
+	re *regexp.Regexp
+}
+
+func (p *authPolicy) matches(req *http.Request) bool {
+	return p.re.MatchString(req.URL.Path) && matchesMethod(p.Methods, req.Method)
+}
+
+// authPolicies is the ordered policy table of the `server.authHeader`
+// section, the first policy matching a request wins. Requests no policy
+// matches need no auth. It decides both what is enforced and which
+// requests are counted as with or without Authorization header.
+type authPolicies []authPolicy
+
+// newAuthPolicies builds the policies of the `server.authHeader` section.
+// Without policies the legacy check.requestPath forms a single
+// policy for the requests below that path, requiring a bearer token if a
+// JWKS file is configured and the presence of the header otherwise.
+func newAuthPolicies(c *Config) (authPolicies, error) {
+	// the policies are compiled in place, keep c untouched
+	policies := append(authPolicies(nil), c.Server.AuthHeader.Policies...)
+	if c.Server.AuthHeader.Policies == nil {
+		auth := authPresence
+		if c.Server.AuthHeader.JWT.JWKSFile != "" {
+			auth = authJWT
+		}
+		policies = authPolicies{{
+			PathRegex: legacyPathRegex(c.Server.AuthHeader.Check.RequestPath),
+			Auth:      auth,
+		}}
+	}
+
+	for i := range policies {
+		policy := &policies[i]
+		re, err := pathRegexp(fmt.Sprintf("server.authHeader.policies[%d]", i), policy.Path, policy.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		policy.re = re
+
+		switch policy.Auth {
+		case authNone, authPresence:
+		case authJWT:
+			if c.Server.AuthHeader.Check.Enabled && c.Server.AuthHeader.JWT.JWKSFile == "" {
+				return nil, fmt.Errorf("invalid server.authHeader.policies[%d].auth [%s]: server.authHeader.jwt.jwksFile is required", i, authJWT)
+			}
+		default:
+			return nil, fmt.Errorf("invalid server.authHeader.policies[%d].auth [%s], must be one of [%s, %s, %s]",
+				i, policy.Auth, authNone, authPresence, authJWT)
+		}
+	}
+	return policies, nil
+}
+
+// lookup returns the auth requirement of req.
+func (p authPolicies) lookup(req *http.Request) string {
+	for i := range p {
+		if p[i].matches(req) {
+			return p[i].Auth
+		}
+	}
+	return authNone
+}
+
+// legacyPathRegex matches every path containing the segments of
+// requestPath and every path below it, every path if requestPath is
+// empty. Like the former substring check it is not tied to the root, but
+// only whole segments match.
+func legacyPathRegex(requestPath string) string {
+	requestPath = strings.Trim(requestPath, "/")
+	if requestPath == "" {
+		return "/.*"
+	}
+	return "(?:/.*)?/" + regexp.QuoteMeta(requestPath) + "(?:/.*)?"
+}
+
+// pathRegexp compiles the path glob or the anchored pathRegex of the
+// entry key of a path table, exactly one of them has to be set.
+func pathRegexp(key, path, pathRegex string) (*regexp.Regexp, error) {
+	var pattern string
+	switch {
+	case path != "" && pathRegex != "":
+		return nil, fmt.Errorf("invalid %s: only one of path and pathRegex may be set", key)
+	case path != "":
+		pattern = globRegex(path)
+	case pathRegex != "":
+		pattern = "^(?:" + pathRegex + ")$"
+	default:
+		return nil, fmt.Errorf("invalid %s: path or pathRegex is required", key)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s.pathRegex: %v", key, err)
+	}
+	return re, nil
+}
+
+// globRegex returns the anchored regular expression of glob.
+func globRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// matchesMethod tells whether method is one of methods, every method
+// matches if methods is empty.
+func matchesMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
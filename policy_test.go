@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobRegex(t *testing.T) {
+	testData := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"/api/v2/device", "/api/v2/device", true},
+		{"/api/v2/device", "/api/v2/device/config", false},
+		{"/api/*/device", "/api/v2/device", true},
+		{"/api/*/device", "/api/v2/x/device", false},
+		{"/api/**", "/api/v2/device/config", true},
+		{"/api/**", "/v2/api/device", false},
+		{"/api/v?/device", "/api/v3/device", true},
+		{"/api/v?/device", "/api/v/device", false},
+		{"/api/v2.device", "/api/v2xdevice", false},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			matched, err := regexp.MatchString(globRegex(record.glob), record.path)
+			require.NoError(t, err)
+			assert.Equal(t, record.match, matched)
+		})
+	}
+}
+
+func TestAuthPolicies(t *testing.T) {
+	v := testViper(t, map[string]interface{}{
+		"server.authHeader.check.enabled": true,
+		"server.authHeader.jwt.jwksFile":  "/etc/petasos-rewriter/jwks.json",
+		"server.authHeader.policies": []map[string]interface{}{
+			{"path": "/api/v2/device/health", "auth": authNone},
+			{"path": "/api/v2/device", "methods": []string{"GET"}, "auth": authJWT},
+			{"pathRegex": "/api/v[0-9]+/.*", "auth": authPresence},
+		},
+	})
+	c, err := loadConfig(v)
+	require.NoError(t, err)
+	policies, err := newAuthPolicies(c)
+	require.NoError(t, err)
+
+	testData := []struct {
+		method string
+		target string
+		auth   string
+	}{
+		{http.MethodGet, "/api/v2/device", authJWT},
+		{http.MethodGet, "/api/v2/device?x=api", authJWT},
+		{http.MethodPost, "/api/v2/device", authPresence},
+		{http.MethodGet, "/api/v2/device/health", authNone},
+		{http.MethodGet, "/api/v3/device/config", authPresence},
+		{http.MethodGet, "/api/vx/device", authNone},
+		{http.MethodGet, "/x/api/v2/device", authNone},
+		{http.MethodGet, "/other?path=api", authNone},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, record.auth, policies.lookup(httptest.NewRequest(record.method, record.target, nil)))
+		})
+	}
+}
+
+func TestLegacyAuthPolicy(t *testing.T) {
+	testData := []struct {
+		requestPath string
+		jwksFile    string
+		target      string
+		auth        string
+	}{
+		{"api", "", "/api/v2/device", authPresence},
+		{"api", "", "/api", authPresence},
+		{"api", "", "/v2/device?x=api", authNone},
+		{"api", "", "/apix/v2/device", authNone},
+		{"/api/v2/", "", "/api/v2/device", authPresence},
+		{"v2/device", "", "/api/v2/device", authPresence},
+		{"v2/device", "", "/api/v2/device/mac:112233445566/stat", authPresence},
+		{"v2/device", "", "/api/v2/devices", authNone},
+		{"v2/device", "", "/api/xv2/device", authNone},
+		{"", "", "/anything", authPresence},
+		{"api", "/etc/petasos-rewriter/jwks.json", "/api/v2/device", authJWT},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v := testViper(t, map[string]interface{}{
+				"server.authHeader.check.requestPath": record.requestPath,
+				"server.authHeader.jwt.jwksFile":      record.jwksFile,
+			})
+			c, err := loadConfig(v)
+			require.NoError(t, err)
+			policies, err := newAuthPolicies(c)
+			require.NoError(t, err)
+			assert.Equal(t, record.auth, policies.lookup(httptest.NewRequest(http.MethodGet, record.target, nil)))
+		})
+	}
+}
+
+func TestNewAuthPoliciesErrors(t *testing.T) {
+	testData := []struct {
+		policies interface{}
+		key      string
+	}{
+		{[]map[string]interface{}{{"auth": authNone}}, "policies[0]"},
+		{[]map[string]interface{}{{"path": "/api", "pathRegex": "/api", "auth": authNone}}, "policies[0]"},
+		{[]map[string]interface{}{{"pathRegex": "(", "auth": authNone}}, "policies[0].pathRegex"},
+		{[]map[string]interface{}{{"path": "/api", "auth": "token"}}, "policies[0].auth"},
+		{[]map[string]interface{}{{"path": "/api", "auth": authJWT}}, "jwksFile"},
+		{"not a list", "policies"},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			v := testViper(t, map[string]interface{}{
+				"server.authHeader.check.enabled": true,
+				"server.authHeader.policies":      record.policies,
+			})
+			c, err := loadConfig(v)
+			if err == nil {
+				_, err = newAuthPolicies(c)
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), record.key)
+		})
+	}
+}
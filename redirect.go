@@ -0,0 +1,64 @@
+package main
+
+import "fmt"
+
+// defaultRedirectStatusCodes are the redirect codes which carry a
+// Location that has to be rewritten.
+var defaultRedirectStatusCodes = []int{301, 302, 303, 307, 308}
+
+// redirectPolicy decides which petasos responses are rewritten and
+// which status code is sent to the device for them.
+type redirectPolicy struct {
+	statusCodes map[int]bool
+	// normalizeStatusCode replaces the status code of every rewritten
+	// redirect when it is not 0
+	normalizeStatusCode int
+}
+
+func newDefaultRedirectPolicy() *redirectPolicy {
+	p := &redirectPolicy{statusCodes: make(map[int]bool, len(defaultRedirectStatusCodes))}
+	for _, code := range defaultRedirectStatusCodes {
+		p.statusCodes[code] = true
+	}
+	return p
+}
+
+// newRedirectPolicy builds the policy from the `redirect` section,
+// without status codes the default ones are rewritten.
+func newRedirectPolicy(c RedirectConfig) (*redirectPolicy, error) {
+	p := newDefaultRedirectPolicy()
+	if c.StatusCodes != nil {
+		p.statusCodes = make(map[int]bool, len(c.StatusCodes))
+		for _, code := range c.StatusCodes {
+			if !isRedirectStatusCode(code) {
+				return nil, fmt.Errorf("invalid redirect.statusCodes: [%d] is not a 3xx status code", code)
+			}
+			p.statusCodes[code] = true
+		}
+	}
+
+	p.normalizeStatusCode = c.NormalizeStatusCode
+	if p.normalizeStatusCode != 0 && !isRedirectStatusCode(p.normalizeStatusCode) {
+		return nil, fmt.Errorf("invalid redirect.normalizeStatusCode: [%d] is not a 3xx status code", p.normalizeStatusCode)
+	}
+	return p, nil
+}
+
+// isRewritten returns true if the Location and body of a response with
+// the given status code have to be rewritten.
+func (p *redirectPolicy) isRewritten(statusCode int) bool {
+	return p.statusCodes[statusCode]
+}
+
+// statusCode returns the status code sent to the device for a rewritten
+// redirect petasos answered with statusCode.
+func (p *redirectPolicy) statusCode(statusCode int) int {
+	if p.normalizeStatusCode != 0 {
+		return p.normalizeStatusCode
+	}
+	return statusCode
+}
+
+func isRedirectStatusCode(code int) bool {
+	return code >= 300 && code < 400
+}
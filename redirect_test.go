@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRedirectPolicy(t *testing.T) {
+	testData := []struct {
+		settings  map[string]interface{}
+		code      int
+		rewritten bool
+		sent      int
+		err       bool
+	}{
+		{nil, 307, true, 307, false},
+		{nil, 302, true, 302, false},
+		{nil, 200, false, 200, false},
+		{nil, 304, false, 304, false},
+		{map[string]interface{}{"redirect.statusCodes": []int{307}}, 302, false, 302, false},
+		{map[string]interface{}{"redirect.statusCodes": []int{302, 307}, "redirect.normalizeStatusCode": 307}, 302, true, 307, false},
+		{map[string]interface{}{"redirect.normalizeStatusCode": 307}, 301, true, 307, false},
+		{map[string]interface{}{"redirect.statusCodes": []int{200}}, 0, false, 0, true},
+		{map[string]interface{}{"redirect.normalizeStatusCode": 200}, 0, false, 0, true},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			c, err := loadConfig(testViper(t, record.settings))
+			var p *redirectPolicy
+			if err == nil {
+				p, err = newRedirectPolicy(c.Redirect)
+			}
+			if record.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(record.rewritten, p.isRewritten(record.code))
+			assert.Equal(record.sent, p.statusCode(record.code))
+		})
+	}
+}
+
+func TestForwarderRewritesEveryRedirectCode(t *testing.T) {
+	testData := []struct {
+		code      int
+		normalize int
+		expected  int
+	}{
+		{http.StatusMovedPermanently, 0, http.StatusMovedPermanently},
+		{http.StatusFound, 0, http.StatusFound},
+		{http.StatusSeeOther, 0, http.StatusSeeOther},
+		{http.StatusTemporaryRedirect, 0, http.StatusTemporaryRedirect},
+		{http.StatusPermanentRedirect, 0, http.StatusPermanentRedirect},
+		{http.StatusFound, http.StatusTemporaryRedirect, http.StatusTemporaryRedirect},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.Header().Set("Location", "http://talaria-1:6200/api/v2/device")
+				response.WriteHeader(record.code)
+			}))
+			defer server.Close()
+			routeToPetasos(t, server.URL)
+			currentConfig().redirects.normalizeStatusCode = record.normalize
+
+			r := httptest.NewRequest("", "/api/v2/device", nil)
+			r.Header.Set("X-Forwarded-Proto", "wss")
+			w := httptest.NewRecorder()
+			client := &http.Client{
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			err := forwarder(echo.New().NewContext(r, w), client)
+			assert.Nil(err)
+			assert.Equal(record.expected, w.Code)
+			assert.Equal("https://talaria-1.dev.rdk.yo-digital.com/api/v2/device", w.Header().Get("Location"))
+		})
+	}
+}
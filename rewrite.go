@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// bodyRewriter replaces oldLocation with newLocation in a redirect body.
+type bodyRewriter func(body []byte, oldLocation, newLocation string) ([]byte, error)
+
+// bodyRewriters are keyed on the media type of the redirect body.
+var bodyRewriters = map[string]bodyRewriter{
+	"text/html":        rewriteHTMLBody,
+	"application/json": rewriteJSONBody,
+	"text/plain":       rewritePlainBody,
+}
+
+// rewriteBody rewrites the location in body according to its content type.
+// Bodies of unknown or missing content type are returned untouched.
+func rewriteBody(contentType string, body []byte, oldLocation, newLocation string) ([]byte, error) {
+	if len(body) == 0 || oldLocation == newLocation {
+		return body, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, nil
+	}
+	rewriter, ok := bodyRewriters[mediaType]
+	if !ok && strings.HasSuffix(mediaType, "+json") {
+		rewriter, ok = rewriteJSONBody, true
+	}
+	if !ok {
+		return body, nil
+	}
+	return rewriter(body, oldLocation, newLocation)
+}
+
+// rewriteHTMLBody rewrites href and src attributes equal to oldLocation.
+// Everything else is copied byte by byte from the original body.
+func rewriteHTMLBody(body []byte, oldLocation, newLocation string) ([]byte, error) {
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return out.Bytes(), nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// Token() lower cases the raw buffer in place, keep a copy
+			raw := append([]byte(nil), z.Raw()...)
+			token := z.Token()
+			if !rewriteHTMLAttributes(token.Attr, oldLocation, newLocation) {
+				out.Write(raw)
+				continue
+			}
+			out.WriteString(token.String())
+		default:
+			out.Write(z.Raw())
+		}
+	}
+}
+
+func rewriteHTMLAttributes(attrs []html.Attribute, oldLocation, newLocation string) bool {
+	rewritten := false
+	for i, attr := range attrs {
+		if attr.Namespace != "" || (attr.Key != "href" && attr.Key != "src") {
+			continue
+		}
+		if attr.Val == oldLocation {
+			attrs[i].Val = newLocation
+			rewritten = true
+		}
+	}
+	return rewritten
+}
+
+// rewriteJSONBody rewrites string values equal to oldLocation, keys and
+// all other values are kept.
+func rewriteJSONBody(body []byte, oldLocation, newLocation string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	doc, rewritten := rewriteJSONValue(doc, oldLocation, newLocation)
+	if !rewritten {
+		return body, nil
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+func rewriteJSONValue(value interface{}, oldLocation, newLocation string) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		if v == oldLocation {
+			return newLocation, true
+		}
+	case map[string]interface{}:
+		rewritten := false
+		for key, element := range v {
+			var ok bool
+			if v[key], ok = rewriteJSONValue(element, oldLocation, newLocation); ok {
+				rewritten = true
+			}
+		}
+		return v, rewritten
+	case []interface{}:
+		rewritten := false
+		for i, element := range v {
+			var ok bool
+			if v[i], ok = rewriteJSONValue(element, oldLocation, newLocation); ok {
+				rewritten = true
+			}
+		}
+		return v, rewritten
+	}
+	return value, false
+}
+
+// rewritePlainBody replaces every literal occurrence of oldLocation.
+func rewritePlainBody(body []byte, oldLocation, newLocation string) ([]byte, error) {
+	return bytes.ReplaceAll(body, []byte(oldLocation), []byte(newLocation)), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteBody(t *testing.T) {
+	const (
+		oldLocation = "http://xmidt-talaria:6200/api/v2/device"
+		newLocation = "https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&b=2"
+	)
+	testData := []struct {
+		contentType string
+		body        string
+		expected    string
+		err         bool
+	}{
+		{
+			contentType: "text/html; charset=utf-8",
+			body:        "<a href=\"http://xmidt-talaria:6200/api/v2/device\">Temporary Redirect</a>.\n",
+			expected:    "<a href=\"https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&amp;b=2\">Temporary Redirect</a>.\n",
+		},
+		{
+			contentType: "text/html",
+			body:        `<p class="x"><a title="t" href="http://xmidt-talaria:6200/api/v2/device">go</a><img src="/logo.png"/><a href="http://other">o</a></p>`,
+			expected:    `<p class="x"><a title="t" href="https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&amp;b=2">go</a><img src="/logo.png"/><a href="http://other">o</a></p>`,
+		},
+		{
+			contentType: "text/html",
+			body:        `<A HREF="http://other" data-x="http://xmidt-talaria:6200/api/v2/device">x</A>`,
+			expected:    `<A HREF="http://other" data-x="http://xmidt-talaria:6200/api/v2/device">x</A>`,
+		},
+		{
+			contentType: "application/json",
+			body:        `{"location":"http://xmidt-talaria:6200/api/v2/device","code":307,"name":"mac:112233445566","list":["http://xmidt-talaria:6200/api/v2/device",1.50]}`,
+			expected:    `{"code":307,"list":["https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&b=2",1.50],"location":"https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&b=2","name":"mac:112233445566"}`,
+		},
+		{
+			contentType: "application/json",
+			body:        `{"name":"mac:112233445566"}`,
+			expected:    `{"name":"mac:112233445566"}`,
+		},
+		{
+			contentType: "application/problem+json",
+			body:        `["http://xmidt-talaria:6200/api/v2/device"]`,
+			expected:    `["https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&b=2"]`,
+		},
+		{
+			contentType: "application/json",
+			body:        `{"location":`,
+			err:         true,
+		},
+		{
+			contentType: "text/plain",
+			body:        "moved to http://xmidt-talaria:6200/api/v2/device, \"really\"",
+			expected:    "moved to https://talaria.dev.rdk.yo-digital.com/api/v2/device?a=1&b=2, \"really\"",
+		},
+		{
+			contentType: "application/octet-stream",
+			body:        "\"http://xmidt-talaria:6200/api/v2/device\"",
+			expected:    "\"http://xmidt-talaria:6200/api/v2/device\"",
+		},
+		{
+			contentType: "",
+			body:        "\"http://xmidt-talaria:6200/api/v2/device\"",
+			expected:    "\"http://xmidt-talaria:6200/api/v2/device\"",
+		},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var (
+				assert      = assert.New(t)
+				actual, err = rewriteBody(record.contentType, []byte(record.body), oldLocation, newLocation)
+			)
+			if record.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(record.expected, string(actual))
+		})
+	}
+}
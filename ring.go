@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// defaultVnodeCount is the number of points each node gets on a ring, the
+// default of petasos.
+const defaultVnodeCount = 211
+
+// hashRing is an immutable consistent hash ring over a set of nodes. It
+// is the ring of github.com/billhathaway/consistentHash petasos uses:
+// nodes get the murmur3 tokens of "<i>=<node>" and keys belong to the
+// node of the first token at or after their own murmur3 token.
+type hashRing struct {
+	tokens []uint64
+	nodes  map[uint64]string
+}
+
+// newHashRing places vnodeCount points per node on the ring.
+func newHashRing(nodes []string, vnodeCount int) *hashRing {
+	if vnodeCount <= 0 {
+		vnodeCount = defaultVnodeCount
+	}
+	r := &hashRing{
+		tokens: make([]uint64, 0, len(nodes)*vnodeCount),
+		nodes:  make(map[uint64]string, len(nodes)*vnodeCount),
+	}
+	for _, node := range nodes {
+		for i := 0; i < vnodeCount; i++ {
+			token := murmur3.Sum64([]byte(strconv.Itoa(i) + "=" + node))
+			if _, ok := r.nodes[token]; !ok {
+				r.tokens = append(r.tokens, token)
+			}
+			// like petasos the node added last owns a shared token
+			r.nodes[token] = node
+		}
+	}
+	sort.Slice(r.tokens, func(i, j int) bool { return r.tokens[i] < r.tokens[j] })
+	return r
+}
+
+// get returns the node owning key, false if the ring is empty.
+func (r *hashRing) get(key []byte) (string, bool) {
+	return r.walk(key, func(string) bool { return true })
+}
+
+// walk returns the first node clockwise from key which is accepted.
+func (r *hashRing) walk(key []byte, accept func(node string) bool) (string, bool) {
+	if len(r.tokens) == 0 {
+		return "", false
+	}
+	token := murmur3.Sum64(key)
+	start := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i] >= token })
+	for i := 0; i < len(r.tokens); i++ {
+		node := r.nodes[r.tokens[(start+i)%len(r.tokens)]]
+		if accept(node) {
+			return node, true
+		}
+	}
+	return "", false
+}
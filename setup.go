@@ -6,6 +6,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/attribute"
@@ -19,15 +20,17 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 )
 
-func logging(v *viper.Viper) {
-	switch v.GetString("level") {
+func logging(c LogConfig) {
+	switch c.Level {
 	case zerolog.DebugLevel.String():
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	case zerolog.InfoLevel.String():
@@ -37,49 +40,53 @@ func logging(v *viper.Viper) {
 	default:
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
-	logType := v.GetString("type")
-	json := v.GetBool("json")
-	if logType == "file" {
-		log.Logger = log.Output(fileAppender(v)).With().Caller().Logger()
-	} else if !json {
+	if c.Type == "file" {
+		log.Logger = log.Output(fileAppender(c)).With().Caller().Logger()
+	} else if !c.JSON {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 	}
 
 }
 
-// printConfig read from cli to stdout
-func printConfig() {
+// printConfig read from cli to stdout with the source of each value,
+// secrets are masked
+func printConfig(flags *pflag.FlagSet) {
+	sources, err := valueSources(viper.GetViper(), flags)
+	if err != nil {
+		log.Error().Msgf("could not tell the sources of the configuration: %v", err)
+	}
+	keys := viper.AllKeys()
+	sort.Strings(keys)
 	fmt.Printf("Config:\n")
-	for _, s := range viper.AllKeys() {
-		fmt.Printf("  %s :                %s\n", s, viper.Get(s))
+	for _, s := range keys {
+		fmt.Printf("  %s :                %s (%s)\n", s, redact(s, viper.Get(s)), sources[s])
 	}
 	fmt.Printf("\n\n")
 }
 
-func fileAppender(v *viper.Viper) io.Writer {
-	dir := v.GetString("dir")
+func fileAppender(c LogConfig) io.Writer {
+	dir := c.Dir
 	if err := os.MkdirAll(dir, 0744); err != nil {
 		log.Error().Err(err).Str("path", dir).Msg("can't create log directory")
 		return nil
 	}
 	return &lumberjack.Logger{
-		Filename:   path.Join(dir, v.GetString("fileName")),
-		MaxSize:    v.GetInt("maxSize"),
-		MaxAge:     v.GetInt("maxAge"),
-		MaxBackups: v.GetInt("maxBackups"),
+		Filename:   path.Join(dir, c.FileName),
+		MaxSize:    c.MaxSize,
+		MaxAge:     c.MaxAge,
+		MaxBackups: c.MaxBackups,
 	}
 
 }
 
-func ConfigureSentry(v *viper.Viper) {
-	sentryDsn := v.GetString("dsn")
-	if sentryDsn == "NA" {
+func ConfigureSentry(c SentryConfig) {
+	if c.DSN == sentryDisabled || c.DSN == "" {
 		return
 	}
 	err := sentry.Init(sentry.ClientOptions{
-		Dsn:              sentryDsn,
-		Environment:      v.GetString("environment"),
-		Debug:            v.GetBool("debug"),
+		Dsn:              c.DSN,
+		Environment:      c.Environment,
+		Debug:            c.Debug,
 		AttachStacktrace: true,
 	})
 	sentry.ConfigureScope(func(scope *sentry.Scope) {
@@ -95,16 +102,17 @@ func ConfigureSentry(v *viper.Viper) {
 
 }
 
-func ConfigureViper(applicationName string) error {
-	viper.AddConfigPath(fmt.Sprintf("/etc/%s", applicationName))
-	viper.AddConfigPath(fmt.Sprintf("$HOME/.%s", applicationName))
-	viper.AddConfigPath(".")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	viper.SetEnvPrefix(applicationName)
-	viper.AutomaticEnv()
-	viper.SetConfigName(applicationName)
-	err := viper.ReadInConfig()
-	return err
+// configureViper sets the config paths and the environment binding, used
+// for the global viper and for every reload. Variables with the
+// PETASOS_REWRITER_ prefix are applied by resolveConfig.
+func configureViper(v *viper.Viper, applicationName string) {
+	v.AddConfigPath(fmt.Sprintf("/etc/%s", applicationName))
+	v.AddConfigPath(fmt.Sprintf("$HOME/.%s", applicationName))
+	v.AddConfigPath(".")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.SetEnvPrefix(applicationName)
+	v.AutomaticEnv()
+	v.SetConfigName(applicationName)
 }
 
 // ConfigureTracerProvider creates the TracerProvider based on the configuration
@@ -112,12 +120,12 @@ func ConfigureViper(applicationName string) error {
 // A different provider can be used if a constructor for it is provided in the
 // config.
 // If a provider name is not provided, a stdout tracerProvider will be returned.
-func configureTracerProvider(v *viper.Viper, applicationName string) (trace.TracerProvider, error) {
-	var traceProviderName = v.GetString(traceProviderType)
+func configureTracerProvider(c TraceProviderConfig, applicationName string) (trace.TracerProvider, error) {
+	var traceProviderName = c.Type
 	switch traceProviderName {
 
 	case zipkinName:
-		traceProvider, err := zipkin.NewExportPipeline(v.GetString(traceProviderEndpoint),
+		traceProvider, err := zipkin.NewExportPipeline(c.Endpoint,
 			zipkin.WithSDKOptions(
 				sdktrace.WithSampler(sdktrace.AlwaysSample()),
 				sdktrace.WithResource(
@@ -126,9 +134,9 @@ func configureTracerProvider(v *viper.Viper, applicationName string) (trace.Trac
 			),
 		)
 		return traceProvider, err
-	case jaegarName:
+	case jaegerName:
 		traceProvider, _, err := jaeger.NewExportPipeline(
-			jaeger.WithCollectorEndpoint(v.GetString(traceProviderEndpoint)),
+			jaeger.WithCollectorEndpoint(c.Endpoint),
 			jaeger.WithSDKOptions(
 				sdktrace.WithSampler(sdktrace.AlwaysSample()),
 				sdktrace.WithResource(
@@ -146,9 +154,8 @@ func configureTracerProvider(v *viper.Viper, applicationName string) (trace.Trac
 	case noopName:
 		return trace.NewNoopTracerProvider(), nil
 	default:
-		var skipTraceExport = v.GetBool(traceProviderSkipTraceExport)
 		var option stdout.Option
-		if skipTraceExport {
+		if c.SkipTraceExport {
 			option = stdout.WithoutTraceExport()
 		} else {
 			option = stdout.WithPrettyPrint()
@@ -162,19 +169,64 @@ func configureTracerProvider(v *viper.Viper, applicationName string) (trace.Trac
 	}
 }
 
-func configureClient(propagators propagation.TextMapPropagator, provider trace.TracerProvider) *http.Client {
-	var transport http.RoundTripper = &http.Transport{}
-	transport = otelhttp.NewTransport(transport,
-		otelhttp.WithPropagators(propagators),
-		otelhttp.WithTracerProvider(provider),
-	)
+// Dialer settings of http.DefaultTransport, which does not expose them
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// newTransport builds the transport used for every upstream from the
+// `upstream.client` section. Settings which are not set or zero keep the
+// ones of http.DefaultTransport.
+func newTransport(c UpstreamClientConfig) *http.Transport {
+	duration := func(d time.Duration, setting *time.Duration) {
+		if d > 0 {
+			*setting = d
+		}
+	}
+	count := func(n int, setting *int) {
+		if n > 0 {
+			*setting = n
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: defaultKeepAlive,
+	}
+	duration(c.DialTimeout, &dialer.Timeout)
+	duration(c.KeepAlive, &dialer.KeepAlive)
 
-	client := &http.Client{
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	duration(c.TLSHandshakeTimeout, &transport.TLSHandshakeTimeout)
+	duration(c.ResponseHeaderTimeout, &transport.ResponseHeaderTimeout)
+	count(c.MaxIdleConns, &transport.MaxIdleConns)
+	count(c.MaxIdleConnsPerHost, &transport.MaxIdleConnsPerHost)
+	duration(c.IdleConnTimeout, &transport.IdleConnTimeout)
+	return transport
+}
+
+// newUpstreamClient returns a client which does not follow redirects,
+// requestTimeout bounds the whole request including reading the body.
+func newUpstreamClient(c UpstreamClientConfig, transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		transport = newTransport(c)
+	}
+	return &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 		Transport: transport,
+		Timeout:   c.RequestTimeout,
 	}
-	return client
+}
 
+func configureClient(c UpstreamClientConfig, propagators propagation.TextMapPropagator, provider trace.TracerProvider) *http.Client {
+	var transport http.RoundTripper = newTransport(c)
+	transport = otelhttp.NewTransport(transport,
+		otelhttp.WithPropagators(propagators),
+		otelhttp.WithTracerProvider(provider),
+	)
+	return newUpstreamClient(c, transport)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	tenantHeader = "X-TENANT-ID"
+	// defaultTenant is the metric label of requests routed with the
+	// default settings
+	defaultTenant = "default"
+	// unknownTenantLabel is the metric label of rejected unknown tenants
+	unknownTenantLabel = "unknown"
+)
+
+// Policies for tenants without a `tenants` entry
+const (
+	unknownTenantReject  = "reject"
+	unknownTenantDefault = "default"
+)
+
+var ErrUnknownTenant = fmt.Errorf("Unknown tenant")
+
+// routingSections are the config sections a tenant can override.
+var routingSections = []string{"petasos", "talaria", "remoteUpdate", "circuitBreaker"}
+
+// routing holds everything needed to forward a request of one tenant.
+type routing struct {
+	tenant              string
+	mode                string
+	petasos             *backendPool
+	talaria             *hostMapper
+	talariaRing         *talariaRing
+	remoteUpdateEnabled bool
+	resourceURL         *url.URL
+	petasosBreaker      *circuitBreaker
+	resourceBreaker     *circuitBreaker
+}
+
+// tenantRouter picks the routing by X-TENANT-ID. Tenant ids are case
+// insensitive, just like every other configuration key.
+type tenantRouter struct {
+	defaultRouting *routing
+	tenants        map[string]*routing
+	unknownPolicy  string
+}
+
+// newTenantRouter builds the default routing from the root sections and
+// one routing per `tenants` entry.
+func newTenantRouter(c *Config) (*tenantRouter, error) {
+	t := &tenantRouter{
+		tenants:       make(map[string]*routing),
+		unknownPolicy: c.Tenancy.UnknownTenant,
+	}
+	switch t.unknownPolicy {
+	case "":
+		t.unknownPolicy = unknownTenantDefault
+	case unknownTenantDefault, unknownTenantReject:
+	default:
+		return nil, fmt.Errorf("invalid tenancy.unknownTenant [%s], must be one of [%s, %s]",
+			t.unknownPolicy, unknownTenantReject, unknownTenantDefault)
+	}
+
+	var err error
+	t.defaultRouting, err = newRouting(defaultTenant, c.RoutingConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, tenant := range c.Tenants {
+		// the metric labels of requests without or with unknown tenant
+		if id == defaultTenant || id == unknownTenantLabel {
+			return nil, fmt.Errorf("invalid tenants.%s: the tenant id is reserved", id)
+		}
+		r, err := newRouting(id, tenant)
+		if err != nil {
+			return nil, fmt.Errorf("tenant [%s]: %v", id, err)
+		}
+		t.tenants[id] = r
+	}
+	return t, nil
+}
+
+// routingSettings returns the routing sections of root with the keys of
+// the override of a tenant applied on top. A tenant overrides single
+// keys, lists like talaria.rules are replaced as a whole.
+func routingSettings(root, override *viper.Viper) *viper.Viper {
+	settings := viper.New()
+	for _, key := range root.AllKeys() {
+		if isRoutingKey(key) {
+			settings.Set(key, root.Get(key))
+		}
+	}
+	if override != nil {
+		// a single endpoint of a tenant replaces the default endpoints
+		if override.IsSet("petasos.endpoint") && !override.IsSet("petasos.endpoints") {
+			settings.Set("petasos.endpoints", []string{})
+		}
+		for _, key := range override.AllKeys() {
+			settings.Set(key, override.Get(key))
+		}
+	}
+	return settings
+}
+
+func isRoutingKey(key string) bool {
+	for _, section := range routingSections {
+		if strings.HasPrefix(key, strings.ToLower(section)+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// newRouting builds the petasos, talaria, remoteUpdate and circuitBreaker
+// sections of c.
+func newRouting(tenant string, c RoutingConfig) (*routing, error) {
+	r := &routing{tenant: tenant, mode: c.Petasos.Mode}
+
+	var err error
+	switch r.mode {
+	case "":
+		r.mode = petasosModeUpstream
+	case petasosModeUpstream, petasosModeEmbedded, petasosModeFallback:
+	default:
+		return nil, fmt.Errorf("invalid petasos.mode [%s], must be one of [%s, %s, %s]",
+			r.mode, petasosModeUpstream, petasosModeEmbedded, petasosModeFallback)
+	}
+
+	// without petasos no endpoint is needed
+	if r.mode != petasosModeEmbedded {
+		r.petasos, err = newBackendPool(c.Petasos)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.talaria, err = newHostMapper(c.Talaria)
+	if err != nil {
+		return nil, err
+	}
+
+	r.talariaRing, err = newTalariaRing(c.Talaria)
+	if err != nil {
+		return nil, err
+	}
+	if r.talariaRing == nil && r.mode != petasosModeUpstream {
+		return nil, fmt.Errorf("invalid petasos.mode [%s]: talaria.instances or talaria.instancesFile is required", r.mode)
+	}
+
+	r.remoteUpdateEnabled = c.RemoteUpdate.Enable
+	if r.remoteUpdateEnabled {
+		r.resourceURL, err = parseRemoteUpdateURL(c.RemoteUpdate.URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.petasosBreaker, err = newCircuitBreaker(upstreamPetasos, tenant, c.CircuitBreaker.Petasos)
+	if err != nil {
+		return nil, err
+	}
+	r.resourceBreaker, err = newCircuitBreaker(upstreamResourceUpdate, tenant, c.CircuitBreaker.ResourceUpdate)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// resolve returns the routing for a X-TENANT-ID value. Requests without
+// tenant use the default routing, unknown tenants are handled according
+// to the policy and result in ErrUnknownTenant when rejected.
+func (t *tenantRouter) resolve(tenantID string) (*routing, error) {
+	if tenantID == "" {
+		return t.defaultRouting, nil
+	}
+	if r, ok := t.tenants[strings.ToLower(tenantID)]; ok {
+		return r, nil
+	}
+	if t.unknownPolicy == unknownTenantReject {
+		return nil, ErrUnknownTenant
+	}
+	return t.defaultRouting, nil
+}
+
+// label returns the tenant metric label of a X-TENANT-ID value. Only
+// configured tenants get their own label to keep cardinality bounded.
+func (t *tenantRouter) label(tenantID string) string {
+	if t == nil {
+		return defaultTenant
+	}
+	r, err := t.resolve(tenantID)
+	if err != nil {
+		return unknownTenantLabel
+	}
+	return r.tenant
+}
+
+// petasosURLs returns every distinct petasos endpoint, sorted.
+func (t *tenantRouter) petasosURLs() []*url.URL {
+	seen := make(map[string]*url.URL)
+	for _, r := range t.all() {
+		if r.petasos == nil {
+			continue
+		}
+		for _, u := range r.petasos.urls() {
+			seen[u.String()] = u
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	urls := make([]*url.URL, 0, len(keys))
+	for _, k := range keys {
+		urls = append(urls, seen[k])
+	}
+	return urls
+}
+
+// requiresPetasos tells whether a routing can not work without petasos.
+func (t *tenantRouter) requiresPetasos() bool {
+	for _, r := range t.all() {
+		if r.mode == petasosModeUpstream {
+			return true
+		}
+	}
+	return false
+}
+
+// routings returns the routing of every configured tenant.
+func (t *tenantRouter) routings() []*routing {
+	return t.all()[1:]
+}
+
+// all returns the default routing followed by the tenant routings.
+func (t *tenantRouter) all() []*routing {
+	routings := make([]*routing, 0, len(t.tenants)+1)
+	routings = append(routings, t.defaultRouting)
+	for _, r := range t.tenants {
+		routings = append(routings, r)
+	}
+	return routings
+}
+
+// inherit carries the circuit breakers and petasos backends of previous
+// over to the routings of the same tenants, a reload must neither close
+// an open breaker nor forget ejections.
+func (t *tenantRouter) inherit(previous *tenantRouter) {
+	if t == nil {
+		return
+	}
+	old := make(map[string]*routing)
+	if previous != nil {
+		for _, r := range previous.all() {
+			old[r.tenant] = r
+		}
+	}
+	for _, r := range t.all() {
+		o, ok := old[r.tenant]
+		delete(old, r.tenant)
+		if !ok {
+			o = &routing{}
+		}
+		r.petasos.inherit(o.petasos)
+		r.petasosBreaker = inheritBreaker(r.petasosBreaker, o.petasosBreaker)
+		r.resourceBreaker = inheritBreaker(r.resourceBreaker, o.resourceBreaker)
+	}
+	// tenants which are gone
+	for _, o := range old {
+		inheritBreaker(nil, o.petasosBreaker)
+		inheritBreaker(nil, o.resourceBreaker)
+	}
+}
+
+// close stops watching the files of the routings.
+func (t *tenantRouter) close() {
+	if t == nil {
+		return
+	}
+	for _, r := range t.all() {
+		r.talariaRing.close()
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routeToPetasos routes requests without tenant to the given petasos,
+// everything else but the auth header check is taken from
+// petasos-rewriter.yaml.
+func routeToPetasos(t *testing.T, petasos string) {
+	t.Helper()
+	cfg, err := newRuntimeConfig(viper.GetViper(), nil)
+	require.NoError(t, err)
+	cfg.tenants.defaultRouting.petasos, err = newBackendPool(PetasosConfig{Endpoint: petasos})
+	require.NoError(t, err)
+	cfg.authHeaderCheckEnabled = false
+	applyConfig(cfg)
+}
+
+func newTestTenantRouter(t *testing.T, policy string) *tenantRouter {
+	t.Helper()
+	v := testViper(t, map[string]interface{}{
+		"petasos.endpoint":      "http://petasos:6400",
+		"talaria.internal":      "talaria",
+		"talaria.external":      "talaria",
+		"talaria.domain":        "example.com",
+		"remoteUpdate.enable":   false,
+		"tenancy.unknownTenant": policy,
+		"tenants": map[string]interface{}{
+			"acme": map[string]interface{}{
+				"petasos": map[string]interface{}{"endpoint": "http://petasos-acme:6400"},
+				"talaria": map[string]interface{}{"domain": "acme.example.com"},
+				"remoteUpdate": map[string]interface{}{
+					"enable": true,
+					"url":    "http://resource-acme:9090/resource",
+				},
+			},
+			"globex": map[string]interface{}{
+				"talaria": map[string]interface{}{
+					"rules": []map[string]interface{}{{"match": `^talaria-(\d+)$`, "replace": "gx$1", "domain": "globex.com"}},
+				},
+			},
+		},
+	})
+	r, err := newTenantRouter(loadTestConfig(t, v))
+	require.NoError(t, err)
+	return r
+}
+
+// loadTenantRouter returns the error of loading the config or of building
+// the router of it.
+func loadTenantRouter(v *viper.Viper) (*tenantRouter, error) {
+	c, err := loadConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	return newTenantRouter(c)
+}
+
+func TestTenantRouter(t *testing.T) {
+	testData := []struct {
+		policy     string
+		tenantID   string
+		tenant     string
+		petasos    string
+		talaria    string
+		resource   string
+		err        error
+		labelValue string
+	}{
+		{"", "", defaultTenant, "http://petasos:6400", "talaria-1.example.com", "", nil, defaultTenant},
+		{"", "ACME", "acme", "http://petasos-acme:6400", "talaria-1.acme.example.com", "http://resource-acme:9090/resource", nil, "acme"},
+		{"", "acme", "acme", "http://petasos-acme:6400", "talaria-1.acme.example.com", "http://resource-acme:9090/resource", nil, "acme"},
+		{"", "globex", "globex", "http://petasos:6400", "gx1.globex.com", "", nil, "globex"},
+		{"", "initech", defaultTenant, "http://petasos:6400", "talaria-1.example.com", "", nil, defaultTenant},
+		{unknownTenantDefault, "initech", defaultTenant, "http://petasos:6400", "talaria-1.example.com", "", nil, defaultTenant},
+		{unknownTenantReject, "initech", "", "", "", "", ErrUnknownTenant, unknownTenantLabel},
+		{unknownTenantReject, "", defaultTenant, "http://petasos:6400", "talaria-1.example.com", "", nil, defaultTenant},
+	}
+	for i, record := range testData {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert := assert.New(t)
+			router := newTestTenantRouter(t, record.policy)
+
+			assert.Equal(record.labelValue, router.label(record.tenantID))
+			r, err := router.resolve(record.tenantID)
+			assert.Equal(record.err, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(record.tenant, r.tenant)
+			assert.Equal(record.petasos, r.petasos.backends[0].String())
+			host, err := r.talaria.mapHost("talaria-1", "6200")
+			assert.NoError(err)
+			assert.Equal(record.talaria, host.Host)
+			assert.Equal(record.resource != "", r.remoteUpdateEnabled)
+			if record.resource != "" {
+				assert.Equal(record.resource, r.resourceURL.String())
+			}
+		})
+	}
+}
+
+func TestTenantRouterPetasosURLs(t *testing.T) {
+	router := newTestTenantRouter(t, "")
+	urls := router.petasosURLs()
+	assert.Len(t, urls, 2)
+	assert.Equal(t, "http://petasos-acme:6400", urls[0].String())
+	assert.Equal(t, "http://petasos:6400", urls[1].String())
+}
+
+func TestNewTenantRouterInvalid(t *testing.T) {
+	v := testViper(t, map[string]interface{}{"tenancy.unknownTenant": "ignore"})
+	_, err := loadTenantRouter(v)
+	assert.Error(t, err)
+
+	v = testViper(t, map[string]interface{}{"tenants.acme.talaria.unmatched.policy": "ignore"})
+	_, err = loadTenantRouter(v)
+	assert.Error(t, err)
+
+	// the ids of the default and unknown tenant labels are reserved
+	for _, id := range []string{"Default", "unknown"} {
+		v = testViper(t, map[string]interface{}{
+			"petasos.endpoint":                  "http://petasos:6400",
+			"talaria.internal":                  "talaria",
+			"tenants." + id + ".talaria.domain": "example.com",
+		})
+		_, err = loadTenantRouter(v)
+		if assert.Error(t, err, id) {
+			assert.Contains(t, err.Error(), "reserved")
+		}
+	}
+}
+
+func TestTenantEndpointReplacesDefaultEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	v := testViper(t, map[string]interface{}{
+		"petasos.endpoints":             []string{"http://petasos-0:6400", "http://petasos-1:6400"},
+		"talaria.internal":              "talaria",
+		"tenants.acme.petasos.endpoint": "http://petasos-acme:6400",
+		"tenants.globex.talaria.domain": "globex.com",
+	})
+	router, err := newTenantRouter(loadTestConfig(t, v))
+	require.NoError(t, err)
+
+	r, _ := router.resolve("acme")
+	assert.Len(r.petasos.backends, 1)
+	assert.Equal("http://petasos-acme:6400", r.petasos.backends[0].String())
+	r, _ = router.resolve("globex")
+	assert.Len(r.petasos.backends, 2)
+}
+
+func TestTenantRouterInheritsState(t *testing.T) {
+	assert := assert.New(t)
+	newRouter := func(coolDown string) *tenantRouter {
+		v := testViper(t, map[string]interface{}{
+			"petasos.endpoints":               []string{"http://petasos-0:6400", "http://petasos-1:6400"},
+			"talaria.internal":                "talaria",
+			"circuitBreaker.petasos.enabled":  true,
+			"circuitBreaker.petasos.coolDown": coolDown,
+		})
+		router, err := newTenantRouter(loadTestConfig(t, v))
+		require.NoError(t, err)
+		return router
+	}
+
+	previous := newRouter("1m")
+	breaker := previous.defaultRouting.petasosBreaker
+	breaker.mu.Lock()
+	breaker.transition(breakerOpen, time.Now())
+	breaker.mu.Unlock()
+	ejected := previous.defaultRouting.petasos.byURL["http://petasos-1:6400"]
+	ejected.ejectedUntil = time.Now().Add(time.Minute)
+
+	// unchanged settings keep the open breaker and the ejected backend
+	reloaded := newRouter("1m")
+	reloaded.inherit(previous)
+	assert.Same(breaker, reloaded.defaultRouting.petasosBreaker)
+	assert.Same(ejected, reloaded.defaultRouting.petasos.byURL["http://petasos-1:6400"])
+	assert.Same(ejected, reloaded.defaultRouting.petasos.backends[1])
+
+	// changed settings replace the breaker
+	changed := newRouter("2m")
+	changed.inherit(reloaded)
+	assert.NotSame(breaker, changed.defaultRouting.petasosBreaker)
+	assert.Equal(breakerClosed, changed.defaultRouting.petasosBreaker.state)
+	assert.Same(ejected, changed.defaultRouting.petasos.byURL["http://petasos-1:6400"])
+}
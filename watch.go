@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// watchDebounce is how long a watched file has to stay unchanged before
+// onChange is called, so that files are not read while being written.
+const watchDebounce = 100 * time.Millisecond
+
+// watchFile calls onChange whenever file is written or replaced, once it
+// stayed unchanged for watchDebounce. The directory is watched so that
+// files replaced by a rename, like the symlink swap of Kubernetes
+// ConfigMap mounts, are noticed too. The returned function stops
+// watching.
+func watchFile(file string, onChange func()) (func(), error) {
+	file = filepath.Clean(file)
+	realFile, _ := filepath.EvalSymlinks(file)
+	return watch(filepath.Dir(file), file, func(event fsnotify.Event) bool {
+		current, _ := filepath.EvalSymlinks(file)
+		written := filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+		if written || (current != "" && current != realFile) {
+			realFile = current
+			return true
+		}
+		return false
+	}, onChange)
+}
+
+// watchDir calls onChange whenever a file in dir is written, created,
+// removed or renamed, once dir stayed unchanged for watchDebounce. The
+// returned function stops watching.
+func watchDir(dir string, onChange func()) (func(), error) {
+	return watch(dir, dir, func(event fsnotify.Event) bool {
+		return event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0
+	}, onChange)
+}
+
+// watch calls onChange watchDebounce after the last event of dir changed
+// accepts, name is the one errors are logged with.
+func watch(dir, name string, changed func(fsnotify.Event) bool, onChange func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	pending := time.NewTimer(watchDebounce)
+	pending.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer pending.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if changed(event) {
+					pending.Reset(watchDebounce)
+				}
+			case <-pending.C:
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Msgf("watching [%s]: %v", name, err)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		watcher.Close()
+	}, nil
+}